@@ -0,0 +1,350 @@
+package arrow
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	authRealm = "GArrow"
+	// nonceTTL is how long a digest nonce is accepted
+	nonceTTL = 5 * time.Minute
+)
+
+// ProxyAuth guards the client's local listeners with a source IP allowlist
+// and Basic or Digest credentials
+type ProxyAuth struct {
+	// plain passwords of config.auth-users, the only ones usable by Digest
+	users map[string]string
+	// htpasswd hashes of config.auth-htpasswd
+	hashes map[string]string
+	allow  []*net.IPNet
+	key    []byte
+}
+
+// NewProxyAuth returns the auth c asks for, nil when it asks for none
+func NewProxyAuth(c *Config) (a *ProxyAuth, err error) {
+	if len(c.AuthUsers) == 0 && c.AuthHtpasswd == "" && len(c.AuthAllow) == 0 {
+		return nil, nil
+	}
+	a = &ProxyAuth{
+		users:  make(map[string]string),
+		hashes: make(map[string]string),
+		key:    make([]byte, 32),
+	}
+	rand.Read(a.key)
+	for _, u := range c.AuthUsers {
+		i := strings.Index(u, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid auth user %s, want user:password", u)
+		}
+		a.users[u[:i]] = u[i+1:]
+	}
+	if c.AuthHtpasswd != "" {
+		if err = a.loadHtpasswd(c.AuthHtpasswd); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range c.AuthAllow {
+		n, err := parseIPNet(s)
+		if err != nil {
+			return nil, err
+		}
+		a.allow = append(a.allow, n)
+	}
+	return
+}
+
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid IP or CIDR: %s", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// loadHtpasswd reads user:hash lines, hashed with htpasswd -m or -s
+func (a *ProxyAuth) loadHtpasswd(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return fmt.Errorf("Invalid htpasswd line: %s", line)
+		}
+		user, hash := line[:i], line[i+1:]
+		if !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return fmt.Errorf("Unsupported htpasswd hash of %s, use htpasswd -m or -s", user)
+		}
+		a.hashes[user] = hash
+	}
+	return s.Err()
+}
+
+// needsCredentials is false when only the allowlist is configured
+func (a *ProxyAuth) needsCredentials() bool {
+	return len(a.users) > 0 || len(a.hashes) > 0
+}
+
+// AllowIP reports whether the peer at addr may use the proxy
+func (a *ProxyAuth) AllowIP(addr string) bool {
+	if a == nil || len(a.allow) == 0 {
+		return true
+	}
+	ip := net.ParseIP(stripPort(addr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify checks a user and password, as sent by Basic or SOCKS5
+func (a *ProxyAuth) Verify(user, password string) bool {
+	if p, ok := a.users[user]; ok {
+		return subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+	}
+	hash, ok := a.hashes[user]
+	if !ok {
+		return false
+	}
+	var got string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		got = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(hash[len("$apr1$"):], "$", 2)[0]
+		got = apr1(password, salt)
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(hash)) == 1
+}
+
+// Check authorizes a proxy request from its Proxy-Authorization header,
+// stale is true for a Digest response to an expired nonce
+func (a *ProxyAuth) Check(r *http.Request) (ok, stale bool) {
+	if a == nil || !a.needsCredentials() {
+		return true, false
+	}
+	h := r.Header.Get("Proxy-Authorization")
+	i := strings.Index(h, " ")
+	if i < 0 {
+		return false, false
+	}
+	switch strings.ToLower(h[:i]) {
+	case "basic":
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(h[i+1:]))
+		if err != nil {
+			return false, false
+		}
+		creds := strings.SplitN(string(b), ":", 2)
+		return len(creds) == 2 && a.Verify(creds[0], creds[1]), false
+	case "digest":
+		return a.checkDigest(r.Method, r.RequestURI, parseAuthParams(h[i+1:]))
+	}
+	return false, false
+}
+
+// checkDigest verifies an RFC 2617 MD5 response
+func (a *ProxyAuth) checkDigest(method, uri string, p map[string]string) (ok, stale bool) {
+	password, found := a.users[p["username"]]
+	if !found || p["realm"] != authRealm || p["uri"] != uri {
+		return false, false
+	}
+	if alg := p["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+		return false, false
+	}
+	ha1 := md5Hex(p["username"] + ":" + authRealm + ":" + password)
+	ha2 := md5Hex(method + ":" + p["uri"])
+	var want string
+	switch p["qop"] {
+	case "auth":
+		want = md5Hex(ha1 + ":" + p["nonce"] + ":" + p["nc"] + ":" + p["cnonce"] + ":auth:" + ha2)
+	case "":
+		want = md5Hex(ha1 + ":" + p["nonce"] + ":" + ha2)
+	default:
+		return false, false
+	}
+	if subtle.ConstantTimeCompare([]byte(want), []byte(p["response"])) != 1 {
+		return false, false
+	}
+	if !a.validNonce(p["nonce"]) {
+		return false, true
+	}
+	return true, false
+}
+
+// Challenge answers 407, offering Digest when some passwords are known
+func (a *ProxyAuth) Challenge(w http.ResponseWriter, stale bool) {
+	if len(a.users) > 0 {
+		d := fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=MD5, nonce="%s"`, authRealm, a.nonce())
+		if stale {
+			d += ", stale=true"
+		}
+		w.Header().Add("Proxy-Authenticate", d)
+	}
+	w.Header().Add("Proxy-Authenticate", fmt.Sprintf(`Basic realm="%s"`, authRealm))
+	http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+}
+
+// nonce is a timestamp signed with the auth key, so nothing is kept per client
+func (a *ProxyAuth) nonce() string {
+	b := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Unix()))
+	m := hmac.New(sha256.New, a.key)
+	m.Write(b)
+	return base64.RawURLEncoding.EncodeToString(m.Sum(b))
+}
+
+func (a *ProxyAuth) validNonce(nonce string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return false
+	}
+	m := hmac.New(sha256.New, a.key)
+	m.Write(b[:8])
+	if !hmac.Equal(m.Sum(nil), b[8:]) {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	return time.Since(issued) < nonceTTL
+}
+
+// parseAuthParams splits key=value, key="quoted, value" pairs
+func parseAuthParams(s string) map[string]string {
+	p := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		i := strings.Index(s, "=")
+		if i < 0 {
+			return p
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " \t")
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			j := 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			value = b.String()
+			if j < len(s) {
+				j++
+			}
+			s = s[j:]
+		} else {
+			j := strings.IndexAny(s, ", \t")
+			if j < 0 {
+				j = len(s)
+			}
+			value, s = s[:j], s[j:]
+		}
+		p[key] = value
+	}
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// apr1 is the Apache MD5 crypt of htpasswd -m
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	alt := md5.Sum([]byte(password + salt + password))
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alt[:])
+		} else {
+			ctx.Write(alt[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte{password[0]})
+		}
+	}
+	final := ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 == 1 {
+			c.Write([]byte(password))
+		} else {
+			c.Write(final)
+		}
+		if i%3 != 0 {
+			c.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			c.Write([]byte(password))
+		}
+		if i&1 == 1 {
+			c.Write(final)
+		} else {
+			c.Write([]byte(password))
+		}
+		final = c.Sum(nil)
+	}
+
+	out := make([]byte, 0, 22)
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(final[0], final[6], final[12], 4)
+	encode(final[1], final[7], final[13], 4)
+	encode(final[2], final[8], final[14], 4)
+	encode(final[3], final[9], final[15], 4)
+	encode(final[4], final[10], final[5], 4)
+	encode(0, 0, final[11], 2)
+	return magic + salt + "$" + string(out)
+}
@@ -0,0 +1,140 @@
+package arrow
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestHtpasswd(t *testing.T) {
+	if got := apr1("secret", "sAlT1234"); got != "$apr1$sAlT1234$mTR3kJvaUqLN49hZ/5Ro2." {
+		t.Errorf("apr1 got %s", got)
+	}
+	if got := apr1("", "ab"); got != "$apr1$ab$S8K6Sgp3W8c9Jb6LxgywZ." {
+		t.Errorf("apr1 of empty password got %s", got)
+	}
+
+	p := filepath.Join(t.TempDir(), "htpasswd")
+	ioutil.WriteFile(p, []byte("# team\nann:$apr1$sAlT1234$mTR3kJvaUqLN49hZ/5Ro2.\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600)
+	a, err := NewProxyAuth(&Config{AuthHtpasswd: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		user, password string
+		want           bool
+	}{
+		{"ann", "secret", true},
+		{"bob", "secret", true},
+		{"ann", "wrong", false},
+		{"eve", "secret", false},
+	} {
+		if a.Verify(c.user, c.password) != c.want {
+			t.Errorf("%s:%s want %v", c.user, c.password, c.want)
+		}
+	}
+
+	ioutil.WriteFile(p, []byte("ann:$2y$05$abcdefghijklmnopqrstuv\n"), 0600)
+	if _, err := NewProxyAuth(&Config{AuthHtpasswd: p}); err == nil {
+		t.Error("bcrypt should be reported as unsupported")
+	}
+}
+
+func TestDigest(t *testing.T) {
+	a, _ := NewProxyAuth(&Config{AuthUsers: []string{"ann:secret"}})
+	nonce := a.nonce()
+	ha1 := md5Hex("ann:" + authRealm + ":secret")
+	ha2 := md5Hex("CONNECT:example.com:443")
+	response := md5Hex(ha1 + ":" + nonce + ":00000001:abc:auth:" + ha2)
+	h := fmt.Sprintf(`Digest username="ann", realm="%s", nonce="%s", uri="example.com:443", `+
+		`qop=auth, nc=00000001, cnonce="abc", response="%s"`, authRealm, nonce, response)
+	r := &http.Request{Method: "CONNECT", RequestURI: "example.com:443", Header: http.Header{"Proxy-Authorization": {h}}}
+	if ok, _ := a.Check(r); !ok {
+		t.Error("valid digest refused")
+	}
+	r.RequestURI = "other.com:443"
+	if ok, _ := a.Check(r); ok {
+		t.Error("digest for another uri accepted")
+	}
+}
+
+func TestProxyAuth(t *testing.T) {
+	var conns int32
+	origin := countingOrigin(&conns)
+	defer origin.Close()
+	_, proxy, stop := startArrow(t, &Config{AuthUsers: []string{"ann:secret"}})
+	defer stop()
+
+	get := func(u *url.URL) *http.Response {
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+		res, err := client.Get(origin.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res
+	}
+	res := get(proxy)
+	if res.StatusCode != http.StatusProxyAuthRequired || len(res.Header["Proxy-Authenticate"]) != 2 {
+		t.Errorf("want 407 with Digest and Basic challenges, got %d %v", res.StatusCode, res.Header)
+	}
+	withUser := *proxy
+	withUser.User = url.UserPassword("ann", "secret")
+	if res := get(&withUser); res.StatusCode != http.StatusOK {
+		t.Errorf("want 200 with credentials, got %d", res.StatusCode)
+	}
+	withUser.User = url.UserPassword("ann", "wrong")
+	if res := get(&withUser); res.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("want 407 with wrong password, got %d", res.StatusCode)
+	}
+
+	// of the local pages only the pac is served without credentials
+	for path, want := range map[string]int{
+		pacPath:     http.StatusOK,
+		statusPath:  http.StatusProxyAuthRequired,
+		capturePath: http.StatusProxyAuthRequired,
+	} {
+		res, err := http.Get(proxy.String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Errorf("%s: want %d, got %d", path, want, res.StatusCode)
+		}
+	}
+	req, _ := http.NewRequest("GET", proxy.String()+statusPath, nil)
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("ann:secret")))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("status with credentials: want 200, got %d", res.StatusCode)
+	}
+}
+
+func TestProxyAuthAllow(t *testing.T) {
+	a, err := NewProxyAuth(&Config{AuthAllow: []string{"10.0.0.0/8", "::1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{
+		"10.1.2.3:5000":  true,
+		"[::1]:5000":     true,
+		"127.0.0.1:5000": false,
+	} {
+		if a.AllowIP(addr) != want {
+			t.Errorf("%s: want %v", addr, want)
+		}
+	}
+	if ok, _ := a.Check(&http.Request{Header: http.Header{}}); !ok {
+		t.Error("allowlist alone should not ask for credentials")
+	}
+}
@@ -0,0 +1,20 @@
+package arrow
+
+import "sync"
+
+const bufSize = 32 * 1024
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, bufSize)
+		return &b
+	},
+}
+
+func getBuf() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+func putBuf(b *[]byte) {
+	bufPool.Put(b)
+}
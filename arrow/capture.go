@@ -0,0 +1,466 @@
+package arrow
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultCaptureMaxBody caps the bytes of each body kept in a capture
+	DefaultCaptureMaxBody = 64 * 1024
+
+	capturePath = "/garrow-capture"
+	tunnelLog   = "tunnels.jsonl"
+	// sniffSize is how much of a tunnel is kept to find the TLS server name
+	sniffSize = 16 * 1024
+)
+
+// capture records the HTTP exchanges with config.capture-hosts as HAR files
+// and the metadata of CONNECT tunnels to them in tunnels.jsonl
+type capture struct {
+	dir     string
+	maxBody int
+	hosts   []string
+	on      int32
+	seq     uint64
+
+	mu sync.Mutex
+}
+
+// newCapture returns nil when c records nothing
+func newCapture(c *Config) (*capture, error) {
+	if len(c.CaptureHosts) == 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(c.CaptureDir, 0700); err != nil {
+		return nil, err
+	}
+	cp := &capture{
+		dir:     c.CaptureDir,
+		maxBody: c.CaptureMaxBody,
+		hosts:   c.CaptureHosts,
+	}
+	cp.setOn(c.Capture)
+	return cp, nil
+}
+
+func (c *capture) setOn(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&c.on, v)
+}
+
+// recording reports whether exchanges with host are recorded, c may be nil
+func (c *capture) recording(host string) bool {
+	if c == nil || atomic.LoadInt32(&c.on) == 0 {
+		return false
+	}
+	host = stripPort(host)
+	for _, p := range c.hosts {
+		if matchHost(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// serve shows whether capture is on, POST {"on": true|false} switches it.
+// Pages of other sites can neither hide their Origin nor post json without
+// a preflight, which nothing here answers.
+func (c *capture) serve(w http.ResponseWriter, r *http.Request) {
+	if c == nil {
+		http.Error(w, "Capture is not configured, see config.capture-hosts", http.StatusNotFound)
+		return
+	}
+	if r.Method == "POST" {
+		if o := r.Header.Get("Origin"); o != "" && o != "http://"+r.Host && o != "https://"+r.Host {
+			http.Error(w, "Cross-site capture switch refused", http.StatusForbidden)
+			return
+		}
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+			http.Error(w, `Switch capture with a json body, {"on": true}`, http.StatusUnsupportedMediaType)
+			return
+		}
+		var body struct {
+			On *bool `json:"on"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(&body); err != nil || body.On == nil {
+			http.Error(w, `Invalid body, want {"on": true} or {"on": false}`, http.StatusBadRequest)
+			return
+		}
+		c.setOn(*body.On)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	state := "off"
+	if atomic.LoadInt32(&c.on) == 1 {
+		state = "on"
+	}
+	fmt.Fprintf(w, "capture: %s\ndir:     %s\nhosts:   %s\n", state, c.dir, strings.Join(c.hosts, ", "))
+}
+
+// exchange is an HTTP request being recorded
+type exchange struct {
+	c       *capture
+	started time.Time
+	req     *http.Request
+	reqBody *limitedBuffer
+	res     *http.Response
+	resBody *limitedBuffer
+	wait    time.Duration
+}
+
+// begin starts recording req, returning nil when it is not captured
+func (c *capture) begin(req *http.Request, host string) *exchange {
+	if !c.recording(host) {
+		return nil
+	}
+	return &exchange{
+		c:       c,
+		started: time.Now(),
+		req:     req,
+		reqBody: &limitedBuffer{max: c.maxBody},
+		resBody: &limitedBuffer{max: c.maxBody},
+	}
+}
+
+// requestBody tees body into the record, e may be nil
+func (e *exchange) requestBody(body io.ReadCloser) io.ReadCloser {
+	if e == nil || body == nil {
+		return body
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, e.reqBody), body}
+}
+
+// response records res, its header just received, and tees its body
+func (e *exchange) response(res *http.Response) io.Reader {
+	if e == nil {
+		return res.Body
+	}
+	e.res = res
+	e.wait = time.Since(e.started)
+	return io.TeeReader(res.Body, e.resBody)
+}
+
+// finish writes the HAR file of the exchange, err being why it failed
+func (e *exchange) finish(err error) {
+	if e == nil {
+		return
+	}
+	entry := e.entry(err)
+	har := harLog{}
+	har.Log.Version = "1.2"
+	har.Log.Creator = harNameVersion{Name: viaName, Version: ""}
+	har.Log.Entries = []harEntry{entry}
+	b, jerr := json.MarshalIndent(har, "", "  ")
+	if jerr != nil {
+		return
+	}
+	name := fmt.Sprintf("%s-%s-%d.har", e.started.Format("20060102-150405"),
+		strings.Replace(stripPort(e.req.URL.Host), ":", "_", -1), atomic.AddUint64(&e.c.seq, 1))
+	ioutil.WriteFile(filepath.Join(e.c.dir, name), b, 0600)
+}
+
+func (e *exchange) entry(err error) harEntry {
+	total := time.Since(e.started)
+	reqBody, reqSize := e.reqBody.snapshot()
+	resBody, resSize := e.resBody.snapshot()
+	entry := harEntry{
+		StartedDateTime: e.started.Format(time.RFC3339Nano),
+		Time:            ms(total),
+		Request: harRequest{
+			Method:      e.req.Method,
+			URL:         e.req.URL.String(),
+			HTTPVersion: e.req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(e.req.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    reqSize,
+		},
+		Response: harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Cache: struct{}{},
+		Timings: harTimings{
+			Send:    0,
+			Wait:    ms(e.wait),
+			Receive: ms(total - e.wait),
+		},
+	}
+	for k, vv := range e.req.URL.Query() {
+		for _, v := range vv {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{k, v})
+		}
+	}
+	if reqSize > 0 {
+		text, _ := harText(reqBody)
+		entry.Request.PostData = &harPostData{MimeType: e.req.Header.Get("Content-Type"), Text: text}
+	}
+	if e.res != nil {
+		text, encoding := harText(resBody)
+		entry.Response.Status = e.res.StatusCode
+		entry.Response.StatusText = http.StatusText(e.res.StatusCode)
+		entry.Response.HTTPVersion = e.res.Proto
+		entry.Response.Headers = harHeaders(e.res.Header)
+		entry.Response.RedirectURL = e.res.Header.Get("Location")
+		entry.Response.BodySize = resSize
+		entry.Response.Content = harContent{
+			Size:     resSize,
+			MimeType: e.res.Header.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+		}
+	}
+	var comments []string
+	if err != nil {
+		comments = append(comments, "error: "+err.Error())
+	}
+	if reqSize > int64(len(reqBody)) || resSize > int64(len(resBody)) {
+		comments = append(comments, fmt.Sprintf("bodies truncated to %d bytes", e.c.maxBody))
+	}
+	entry.Comment = strings.Join(comments, "; ")
+	return entry
+}
+
+// limitedBuffer keeps the first max bytes written and counts them all. It's
+// locked, the transport may still be writing a request body to it while the
+// exchange is recorded.
+type limitedBuffer struct {
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	max  int
+	size int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size += int64(len(p))
+	if room := b.max - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// snapshot copies the bytes kept so far, size counts all written
+func (b *limitedBuffer) snapshot() (kept []byte, size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...), b.size
+}
+
+// harText is a body as HAR wants it, base64 unless it is UTF-8
+func harText(b []byte) (text, encoding string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// tunnelCapture is a CONNECT being recorded
+type tunnelCapture struct {
+	c       *capture
+	started time.Time
+	host    string
+	client  string
+	sniff   *limitedBuffer
+}
+
+// tunnelRecord is a line of tunnels.jsonl
+type tunnelRecord struct {
+	Started  string  `json:"started"`
+	Host     string  `json:"host"`
+	SNI      string  `json:"sni,omitempty"`
+	Client   string  `json:"client"`
+	Duration float64 `json:"duration_ms"`
+	Up       int64   `json:"up"`
+	Down     int64   `json:"down"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// beginTunnel starts recording the CONNECT r, nil when it is not captured
+func (c *capture) beginTunnel(r *http.Request) *tunnelCapture {
+	if !c.recording(r.Host) {
+		return nil
+	}
+	return &tunnelCapture{
+		c:       c,
+		started: time.Now(),
+		host:    r.Host,
+		client:  r.RemoteAddr,
+		sniff:   &limitedBuffer{max: sniffSize},
+	}
+}
+
+// wrap keeps the start of what the client sends to find the server name
+func (t *tunnelCapture) wrap(conn net.Conn) net.Conn {
+	if t == nil {
+		return conn
+	}
+	return &sniffConn{Conn: conn, sniff: t.sniff}
+}
+
+// finish appends the record of the tunnel to tunnels.jsonl
+func (t *tunnelCapture) finish(up, down int64, err error) {
+	if t == nil {
+		return
+	}
+	sniffed, _ := t.sniff.snapshot()
+	rec := tunnelRecord{
+		Started:  t.started.Format(time.RFC3339Nano),
+		Host:     t.host,
+		SNI:      parseSNI(sniffed),
+		Client:   t.client,
+		Duration: ms(time.Since(t.started)),
+		Up:       up,
+		Down:     down,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	b, _ := json.Marshal(rec)
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	f, ferr := os.OpenFile(filepath.Join(t.c.dir, tunnelLog), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if ferr != nil {
+		return
+	}
+	f.Write(append(b, '\n'))
+	f.Close()
+}
+
+// sniffConn copies what is read into sniff, up to its limit
+type sniffConn struct {
+	net.Conn
+	sniff *limitedBuffer
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.sniff.Write(b[:n])
+	}
+	return n, err
+}
+
+// CloseWrite keeps half-close working through the wrapper
+func (c *sniffConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// HAR 1.2, http://www.softwareishard.com/blog/har-12-spec/
+type harLog struct {
+	Log struct {
+		Version string         `json:"version"`
+		Creator harNameVersion `json:"creator"`
+		Entries []harEntry     `json:"entries"`
+	} `json:"log"`
+}
+
+type harNameVersion struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	hs := []harNameValue{}
+	for _, k := range keys {
+		for _, v := range h[k] {
+			hs = append(hs, harNameValue{k, v})
+		}
+	}
+	return hs
+}
@@ -0,0 +1,191 @@
+package arrow
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSNI(t *testing.T) {
+	c, s := net.Pipe()
+	defer s.Close()
+	go tls.Client(c, &tls.Config{ServerName: "api.example.com"}).Handshake()
+	hello := make([]byte, sniffSize)
+	n, _ := s.Read(hello)
+	hello = hello[:n]
+	if got := parseSNI(hello); got != "api.example.com" {
+		t.Errorf("want api.example.com, got %q", got)
+	}
+	for _, b := range [][]byte{hello[:40], nil, []byte("GET / HTTP/1.1\r\n")} {
+		if got := parseSNI(b); got != "" {
+			t.Errorf("want no server name, got %q", got)
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+	origin := echoOrigin()
+	defer origin.Close()
+	echo := echoListener(t)
+	defer echo.Close()
+	dir := t.TempDir()
+	_, proxy, stop := startArrow(t, &Config{
+		Capture:      true,
+		CaptureHosts: []string{"127.0.0.1"},
+		CaptureDir:   dir,
+	})
+	defer stop()
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+
+	res, err := client.Post(origin.URL+"/api?x=1", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	hars, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	if len(hars) != 1 {
+		t.Fatalf("want 1 har file, got %v", hars)
+	}
+	var har harLog
+	b, _ := ioutil.ReadFile(hars[0])
+	if err := json.Unmarshal(b, &har); err != nil || len(har.Log.Entries) != 1 {
+		t.Fatalf("bad har %s: %v", b, err)
+	}
+	e := har.Log.Entries[0]
+	if e.Request.Method != "POST" || e.Request.PostData == nil || e.Request.PostData.Text != "hello" ||
+		len(e.Request.QueryString) != 1 {
+		t.Errorf("bad request %+v", e.Request)
+	}
+	if e.Response.Status != 200 || e.Response.Content.Text != "hello" {
+		t.Errorf("bad response %+v", e.Response)
+	}
+
+	conn, err := net.Dial("tcp", proxy.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\nping", echo.Addr())
+	br := bufio.NewReader(conn)
+	http.ReadResponse(br, nil)
+	io.ReadFull(br, make([]byte, 4))
+	conn.Close()
+	// the record is written once the tunnel is done
+	var rec tunnelRecord
+	for i := 0; i < 50 && rec.Host == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		b, _ := ioutil.ReadFile(filepath.Join(dir, tunnelLog))
+		json.Unmarshal(b, &rec)
+	}
+	if rec.Host != echo.Addr().String() || rec.Up != 4 || rec.Down != 4 {
+		t.Errorf("bad tunnel record %+v", rec)
+	}
+
+	// what a form or script of another site could send
+	res, err = http.PostForm(proxy.String()+capturePath, url.Values{"on": {"false"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("form switch: want 415, got %d", res.StatusCode)
+	}
+	switchCapture := func(origin string) *http.Response {
+		req, _ := http.NewRequest("POST", proxy.String()+capturePath, strings.NewReader(`{"on": false}`))
+		req.Header.Set("Content-Type", "application/json")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	res = switchCapture("http://evil.example")
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("cross-site switch: want 403, got %d", res.StatusCode)
+	}
+	res = switchCapture("")
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(body), "capture: off") {
+		t.Errorf("want capture off, got %s", body)
+	}
+	res, _ = client.Get(origin.URL + "/off")
+	res.Body.Close()
+	if hars, _ := filepath.Glob(filepath.Join(dir, "*.har")); len(hars) != 1 {
+		t.Errorf("recorded with capture off: %v", hars)
+	}
+}
+
+// echoOrigin answers with the request body
+func echoOrigin() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+}
+
+func TestCaptureEarlyResponse(t *testing.T) {
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	go func() {
+		c, err := origin.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// answers before the request body is all sent
+		br := bufio.NewReader(c)
+		http.ReadRequest(br)
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nearly")
+		io.Copy(ioutil.Discard, br)
+	}()
+	dir := t.TempDir()
+	_, proxy, stop := startArrow(t, &Config{
+		Capture:      true,
+		CaptureHosts: []string{"127.0.0.1"},
+		CaptureDir:   dir,
+		// the server tunnel only answers once the body is sent
+		Rules: []Rule{{Hosts: []string{"127.0.0.1"}, Action: ActionDirect}},
+	})
+	defer stop()
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+
+	n := 0
+	body := readerFunc(func(p []byte) (int, error) {
+		if n == 50 {
+			return 0, io.EOF
+		}
+		n++
+		time.Sleep(time.Millisecond)
+		return copy(p, "chunk"), nil
+	})
+	res, err := client.Post("http://"+origin.Addr().String()+"/", "text/plain", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	// the request body was still being teed into the record
+	if hars, _ := filepath.Glob(filepath.Join(dir, "*.har")); len(hars) != 1 {
+		t.Errorf("want 1 har file, got %v", hars)
+	}
+}
@@ -5,13 +5,16 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 )
 
 type Cipher struct {
 	block cipher.Block
+	ctr   bool
 	encer cipher.Stream
 	decer cipher.Stream
 }
@@ -22,7 +25,11 @@ func (c *Cipher) initEncer() (iv []byte) {
 		fmt.Fprintln(os.Stderr, "Error initialize encer:", err)
 		return
 	}
-	c.encer = cipher.NewCFBEncrypter(c.block, iv)
+	if c.ctr {
+		c.encer = cipher.NewCTR(c.block, iv)
+	} else {
+		c.encer = cipher.NewCFBEncrypter(c.block, iv)
+	}
 	return
 }
 
@@ -33,18 +40,124 @@ func (c *Cipher) Encrypt(plain []byte) (ciphered []byte) {
 }
 
 func (c *Cipher) initDecer(iv []byte) {
-	c.decer = cipher.NewCFBDecrypter(c.block, iv)
+	if c.ctr {
+		c.decer = cipher.NewCTR(c.block, iv)
+	} else {
+		c.decer = cipher.NewCFBDecrypter(c.block, iv)
+	}
 }
 
 func (c *Cipher) Decrypt(ciphered []byte) {
 	c.decer.XORKeyStream(ciphered, ciphered)
 }
 
-func NewCipher(password string) (c *Cipher, err error) {
-	key := sha256.Sum256([]byte(password))
-	block, err := aes.NewCipher(key[:])
+// DefaultMethod is used when config.method is empty
+const DefaultMethod = "aes-256-cfb"
+
+// cipherMethod is an entry of the registry shared by both protocols
+type cipherMethod struct {
+	keySize int
+	// ctr streams are xored with AES-CTR instead of AES-CFB
+	ctr bool
+	// aead methods seal chunks, only spoken with protocol shadowsocks
+	aead bool
+}
+
+// cipherMethods maps method name to how it encrypts
+var cipherMethods = map[string]cipherMethod{
+	// none relays in plain text, only for links already encrypted otherwise
+	"none":        {},
+	"aes-128-cfb": {keySize: 16},
+	"aes-192-cfb": {keySize: 24},
+	"aes-256-cfb": {keySize: 32},
+	"aes-128-ctr": {keySize: 16, ctr: true},
+	"aes-192-ctr": {keySize: 24, ctr: true},
+	"aes-256-ctr": {keySize: 32, ctr: true},
+	"aes-128-gcm": {keySize: 16, aead: true},
+	"aes-192-gcm": {keySize: 24, aead: true},
+	"aes-256-gcm": {keySize: 32, aead: true},
+}
+
+// replayFilterSize is how many IVs or salts a replayFilter generation holds
+const replayFilterSize = 1 << 16
+
+// replayFilter remembers the IVs and salts a server has seen, the recent
+// ones at least, so a recorded tunnel can't be sent again
+type replayFilter struct {
+	mu        sync.Mutex
+	cur, prev map[string]struct{}
+}
+
+func newReplayFilter() *replayFilter {
+	return &replayFilter{cur: make(map[string]struct{})}
+}
+
+// add records iv, false when it was already seen
+func (f *replayFilter) add(iv []byte) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	k := string(iv)
+	if _, ok := f.cur[k]; ok {
+		return false
+	}
+	if _, ok := f.prev[k]; ok {
+		return false
+	}
+	if len(f.cur) >= replayFilterSize {
+		f.prev, f.cur = f.cur, make(map[string]struct{})
+	}
+	f.cur[k] = struct{}{}
+	return true
+}
+
+// GenerateKey returns a random url-safe password strong enough for any method
+func GenerateKey() (key string, err error) {
+	b := make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, b); err != nil {
+		return
+	}
+	key = base64.RawURLEncoding.EncodeToString(b)
+	return
+}
+
+// NewCipher returns the stream cipher of method, its key derived from
+// password the garrow way
+func NewCipher(method, password string) (c *Cipher, err error) {
+	return newCipher(method, password, ProtocolGArrow)
+}
+
+// newCipher returns the stream cipher of method for protocol, whose key
+// derivation differs
+func newCipher(method, password, protocol string) (c *Cipher, err error) {
+	if method == "" {
+		method = DefaultMethod
+	}
+	m, ok := cipherMethods[method]
+	if !ok {
+		err = fmt.Errorf("Unsupported cipher method: %s", method)
+		return
+	}
+	if m.aead {
+		err = fmt.Errorf("Cipher method %s is not a stream cipher", method)
+		return
+	}
+	if m.keySize == 0 {
+		return &Cipher{}, nil
+	}
+	var key []byte
+	if protocol == ProtocolShadowsocks {
+		key = evpBytesToKey(password, m.keySize)
+	} else {
+		sum := sha256.Sum256([]byte(password))
+		key = sum[:m.keySize]
+	}
+	block, err := aes.NewCipher(key)
 	c = &Cipher{
 		block: block,
+		ctr:   m.ctr,
 	}
 	return
 }
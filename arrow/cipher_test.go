@@ -8,7 +8,7 @@ func TestEncDec(t *testing.T) {
 	plain := []byte("fuck1")
 	password := "000"
 
-	c, _ := NewCipher(password)
+	c, _ := NewCipher(DefaultMethod, password)
 	iv := c.initEncer()
 	ciphered := c.Encrypt(plain)
 	c.initDecer(iv)
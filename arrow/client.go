@@ -1,11 +1,12 @@
 package arrow
 
 import (
-	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	raven "github.com/getsentry/raven-go"
@@ -24,107 +25,315 @@ var hopHeaders = []string{
 }
 
 type ProxyHandler struct {
-	serverAddr string
-	logger     *logrus.Logger
-	password   string
+	config  *Config
+	logger  *logrus.Logger
+	stats   *ruleStats
+	auth    *ProxyAuth
+	mitm    *mitm
+	capture *capture
+	// dial replaces routing through the server when set, on the server
+	// itself
+	dial func(rHost string) (net.Conn, error)
+
+	mu         sync.Mutex
+	transports map[Timeouts]*http.Transport
 }
 
 func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.logger.Infoln(r.Method, r.URL, r.Proto)
+	if !h.auth.AllowIP(r.RemoteAddr) {
+		h.logger.Infoln("Refused", r.RemoteAddr, "not in config.auth-allow")
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	local := isLocal(r)
+	if local && h.dial != nil {
+		// the server proxy has no pages of its own
+		http.NotFound(w, r)
+		return
+	}
+	// browsers fetch the pac before they know the proxy wants credentials
+	if !local || r.URL.Path != pacPath {
+		if ok, stale := h.auth.Check(r); !ok {
+			h.auth.Challenge(w, stale)
+			return
+		}
+	}
+	if local {
+		h.serveLocal(w, r)
+		return
+	}
+	upgrade := extendedConnect(r)
+	if upgrade == "" {
+		upgrade = upgradeType(r.Header)
+	}
 	h.preprocessHeader(r)
+	if r.Method == "CONNECT" && !h.mitm.intercepts(r.Host) {
+		h.connect(w, r)
+		return
+	}
+	config, direct := h.stats.route(h.config, r.Host)
 
 	if r.Method == "CONNECT" {
-		rConn, err := Dial("tcp4", h.serverAddr, h.password)
+		cConn, err := h.establish(w, r)
 		if err != nil {
-			fmt.Fprintln(w, "Error connecting proxy server: ", err)
 			return
 		}
-		defer rConn.Close()
+		defer cConn.Close()
+		h.intercept(cConn, r.Host, config, direct)
+	} else if upgrade != "" {
+		h.serveUpgrade(w, r, config, direct, upgrade)
+	} else {
+		h.forwardHTTP(w, r, config, direct)
+	}
+}
 
-		err = setHost(rConn, r.Host)
+// connect tunnels a CONNECT. When sniffing, the client is answered before
+// dialing, as it only speaks once the tunnel is up, so failures to dial no
+// longer get a 502. Only IP destinations are sniffed for that, unless the
+// sniffed name overrides the destination.
+func (h *ProxyHandler) connect(w http.ResponseWriter, r *http.Request) {
+	sniff := h.config.Sniff && (h.config.SniffOverride || net.ParseIP(stripPort(r.Host)) != nil)
+	if !sniff || r.ProtoMajor != 1 {
+		// HTTP/2 streams can't time out a read, nothing is sniffed there
+		config, direct := h.stats.route(h.config, r.Host)
+		rConn, err := h.dialHost(config, r.Host, direct)
 		if err != nil {
-			fmt.Fprintln(w, "Error negotiating with proxy server", err)
+			http.Error(w, fmt.Sprint("Error connecting proxy server: ", err), http.StatusBadGateway)
 			return
 		}
-
-		hj, ok := w.(http.Hijacker)
-		if !ok {
-			fmt.Fprintln(w, "Error doing proxy hijack:", http.StatusInternalServerError)
-			return
-		}
-		// TODO(ibigbug): ignore the hijack buf
-		// If meet strange packet lossing issue, check here
-		cConn, _, err := hj.Hijack()
-		defer cConn.Close()
+		defer rConn.Close()
+		cConn, err := h.establish(w, r)
 		if err != nil {
-			raven.CaptureErrorAndWait(err, nil)
-			fmt.Fprintln(w, "Error doing proxy hijack:", err)
 			return
 		}
-		cConn.Write([]byte("HTTP/1.0 200 Connection Established\r\n\r\n"))
+		defer cConn.Close()
+		h.tunnel(r, cConn, rConn)
+		return
+	}
 
-		go pipeConn(cConn, rConn)
-		pipeConn(rConn, cConn)
-	} else {
-		defer r.Body.Close()
-		var d = &map[string]string{
-			"password": h.password,
-			"rHost":    r.Host,
-			"address":  h.serverAddr,
-		}
-		var ctx = context.WithValue(r.Context(), "d", d)
-		res, err := ArrowTransport.RoundTrip(r.WithContext(ctx))
-		if err != nil {
-			raven.CaptureErrorAndWait(err, nil)
-			w.WriteHeader(http.StatusBadGateway)
-			fmt.Fprintln(w, "Error proxy request:", err)
-			return
-		}
-		if res.Body != nil {
-			defer res.Body.Close()
-		}
-		writeHeader(w, res.Header)
-		w.WriteHeader(res.StatusCode)
-		io.Copy(w, res.Body)
-		// TODO(ibigbug) Trailers
+	cConn, err := h.establish(w, r)
+	if err != nil {
+		return
+	}
+	defer cConn.Close()
+	cConn, s := h.config.sniff(cConn, r.Host)
+	if s.name != "" {
+		h.logger.Infoln("CONNECT", r.Host, "is", s.name)
+	}
+	config, direct := h.stats.route(h.config, s.route)
+	rConn, err := h.dialHost(config, s.dial, direct)
+	if err != nil {
+		h.logger.Errorln("Error connecting", s.dial, ":", err)
+		return
 	}
+	defer rConn.Close()
+	h.tunnel(r, cConn, rConn)
+}
+
+// dialHost connects to rHost as routed, or with h.dial when set
+func (h *ProxyHandler) dialHost(config *Config, rHost string, direct bool) (net.Conn, error) {
+	if h.dial != nil {
+		return h.dial(rHost)
+	}
+	return dialHost(config, rHost, direct)
+}
+
+// tunnel relays an established CONNECT, capturing it when asked
+func (h *ProxyHandler) tunnel(r *http.Request, cConn, rConn net.Conn) {
+	t := h.capture.beginTunnel(r)
+	up, down, err := relay(t.wrap(cConn), rConn)
+	t.finish(up, down, err)
+	h.logger.Debugln("CONNECT", r.Host, "done, up:", up, "down:", down, "err:", err)
+}
+
+// establish answers a CONNECT and returns the client side of the tunnel,
+// the hijacked conn or for HTTP/2 the stream
+func (h *ProxyHandler) establish(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if r.ProtoMajor == 2 {
+		// a stream of a shared conn, nothing to hijack
+		w.WriteHeader(http.StatusOK)
+		return newStreamConn(w, r), nil
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		fmt.Fprintln(w, "Error doing proxy hijack:", http.StatusInternalServerError)
+		return nil, fmt.Errorf("Error doing proxy hijack")
+	}
+	cConn, buf, err := hj.Hijack()
+	if err != nil {
+		raven.CaptureErrorAndWait(err, nil)
+		fmt.Fprintln(w, "Error doing proxy hijack:", err)
+		return nil, err
+	}
+	fmt.Fprintf(cConn, "HTTP/%d.%d 200 Connection Established\r\n\r\n", r.ProtoMajor, r.ProtoMinor)
+	// bytes sent right after the request, e.g. an eager TLS ClientHello,
+	// may already sit in the hijacked buffer
+	return &bufferedConn{cConn, buf.Reader}, nil
+}
+
+// transport returns the shared transport for t, one per distinct timeouts
+func (h *ProxyHandler) transport(t Timeouts) *http.Transport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.transports == nil {
+		h.transports = make(map[Timeouts]*http.Transport)
+	}
+	tr, ok := h.transports[t]
+	if !ok {
+		tr = NewArrowTransport(t)
+		tr.TLSClientConfig = &tls.Config{RootCAs: h.mitm.originRoots()}
+		h.transports[t] = tr
+	}
+	return tr
 }
 
 func (h *ProxyHandler) preprocessHeader(r *http.Request) {
-	for _, h := range hopHeaders {
-		r.Header.Del(h)
+	// TE is hop-by-hop but origins such as grpc need to know trailers work
+	trailers := headerHasToken(r.Header, "Te", "trailers")
+	removeHopHeaders(r.Header)
+	if trailers {
+		r.Header.Set("Te", "trailers")
 	}
 }
 
 type Client struct {
 	*Config
-	logger *logrus.Logger
+	logger  *logrus.Logger
+	stats   *ruleStats
+	auth    *ProxyAuth
+	mitm    *mitm
+	capture *capture
 }
 
+// Run serves the http proxy on config.local, and every other listener
+// configured, all of them listening before any is served
 func (c *Client) Run() (err error) {
+	var closers []io.Closer
+	defer func() {
+		if err != nil {
+			for _, cl := range closers {
+				cl.Close()
+			}
+		}
+	}()
+	var serves []func() error
+	listen := func(name, address string, listen func(string) (net.Listener, error), serve func(net.Listener) error) error {
+		l, err := listen(address)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, l)
+		serves = append(serves, func() error {
+			c.logger.Infoln("Running", name, "at:", address)
+			return serve(l)
+		})
+		return nil
+	}
+	tcp := func(address string) (net.Listener, error) {
+		return net.Listen("tcp", address)
+	}
+
+	if err = listen("client", c.LocalAddress, tcp, c.Serve); err != nil {
+		return
+	}
+	if c.SocksAddress != "" {
+		if err = listen("socks5", c.SocksAddress, tcp, c.ServeSocks); err != nil {
+			return
+		}
+	}
+	if c.RedirAddress != "" {
+		if err = listen("redirect proxy", c.RedirAddress, tcp, c.ServeRedirect); err != nil {
+			return
+		}
+	}
+	if c.TProxyAddress != "" {
+		tproxy := func(address string) (net.Listener, error) {
+			return ListenTProxy("tcp", address)
+		}
+		if err = listen("tproxy", c.TProxyAddress, tproxy, c.ServeTProxy); err != nil {
+			return
+		}
+		if c.TProxyUDP {
+			var pc *net.UDPConn
+			if pc, err = ListenTProxyUDP(c.TProxyAddress); err != nil {
+				return
+			}
+			closers = append(closers, pc)
+			serves = append(serves, func() error { return c.ServeTProxyUDP(pc) })
+		}
+	}
+	for _, f := range c.Forwards {
+		to := f.To
+		serve := func(l net.Listener) error {
+			return c.ServeForward(l, to)
+		}
+		if err = listen("forward to "+to, f.Listen, tcp, serve); err != nil {
+			return
+		}
+	}
+	for _, f := range c.Reverses {
+		f := f
+		serves = append(serves, func() error { return c.RunReverse(f) })
+	}
+	if c.DNS.Listen != "" {
+		var p *DNSProxy
+		if p, err = NewDNSProxy(c.Config, c.logger); err != nil {
+			return
+		}
+		serves = append(serves, func() error {
+			c.logger.Infoln("Running dns at:", c.DNS.Listen)
+			return p.ListenAndServe(c.DNS.Listen)
+		})
+	}
+
+	// the http proxy, listened first, keeps Run blocking
+	for _, serve := range serves[1:] {
+		go func(serve func() error) {
+			if err := serve(); err != nil {
+				c.logger.Errorln("Error serving: ", err)
+			}
+		}(serve)
+	}
+	return serves[0]()
+}
+
+// Serve proxies requests accepted from l
+func (c *Client) Serve(l net.Listener) error {
 	h := &ProxyHandler{
-		serverAddr: c.ServerAddress,
-		logger:     c.logger,
-		password:   c.Password,
+		config:  c.Config,
+		logger:  c.logger,
+		stats:   c.stats,
+		auth:    c.auth,
+		mitm:    c.mitm,
+		capture: c.capture,
 	}
 
 	s := http.Server{
-		Handler: h,
+		Handler:   h,
+		Protocols: c.protocols(),
 	}
-
-	var l net.Listener
-	if l, err = net.Listen("tcp", c.LocalAddress); err != nil {
-		return err
+	if c.LocalTLSCert != "" {
+		return s.ServeTLS(l, c.LocalTLSCert, c.LocalTLSKey)
 	}
-	c.logger.Infoln("Running client at: ", c.LocalAddress)
 	return s.Serve(l)
 }
 
 func NewClient(c *Config) (s Runnable) {
-	var logger = getLogger("client")
+	var logger = getLogger("client", c.LogLevel)
+	auth, err := NewProxyAuth(c)
+	checkError(err)
+	m, err := newMITM(c)
+	checkError(err)
+	cp, err := newCapture(c)
+	checkError(err)
 	s = &Client{
-		Config: c,
-		logger: logger,
+		Config:  c.forSide(c.ClientTimeouts),
+		logger:  logger,
+		stats:   newRuleStats(c),
+		auth:    auth,
+		mitm:    m,
+		capture: cp,
 	}
 	return
 }
@@ -1,23 +1,157 @@
 package arrow
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
 )
 
+const (
+	// EnvPrefix prefixes every config key when read from environment
+	EnvPrefix = "GARROW_"
+
+	redacted = "******"
+)
+
+// ConfigKeys are the keys accepted by Config.Set, in the order they're documented
+var ConfigKeys = []string{
+	"uri",
+	"name",
+	"server",
+	"server-proxy",
+	"local",
+	"local-http2",
+	"local-tls-cert",
+	"local-tls-key",
+	"socks",
+	"redir",
+	"tproxy",
+	"tproxy-udp",
+	"sniff",
+	"sniff-override",
+	"auth-users",
+	"auth-htpasswd",
+	"auth-allow",
+	"mitm-hosts",
+	"mitm-ca-cert",
+	"mitm-ca-key",
+	"capture",
+	"capture-hosts",
+	"capture-dir",
+	"capture-max-body",
+	"forward",
+	"reverse",
+	"reverse-token",
+	"reverse-ports",
+	"reverse-max-tunnels",
+	"reverse-max-conns",
+	"password",
+	"password-file",
+	"method",
+	"protocol",
+	"allow-plaintext",
+	"log-level",
+	"handshake-timeout",
+	"dial-timeout",
+	"idle-timeout",
+	"response-header-timeout",
+	"idle-conn-timeout",
+	"keepalive",
+	"pool-max-idle-per-host",
+	"pool-max-idle",
+	"ip-preference",
+	"egress",
+	"dns",
+	"dns-listen",
+	"transport",
+}
+
 // Config struct
 type Config struct {
-	ServerAddress string `yaml:"server,omitempty"`
-	LocalAddress  string `yaml:"local,omitempty"`
-	Password      string `yaml:"password,omitempty"`
+	ServerURI      string   `yaml:"uri,omitempty"`
+	Servers        []string `yaml:"servers,omitempty"`
+	Name           string   `yaml:"name,omitempty"`
+	ServerAddress  string   `yaml:"server,omitempty"`
+	ServerProxy    string   `yaml:"server-proxy,omitempty"`
+	LocalAddress   string   `yaml:"local,omitempty"`
+	LocalHTTP2     bool     `yaml:"local-http2,omitempty"`
+	LocalTLSCert   string   `yaml:"local-tls-cert,omitempty"`
+	LocalTLSKey    string   `yaml:"local-tls-key,omitempty"`
+	SocksAddress   string   `yaml:"socks,omitempty"`
+	RedirAddress   string   `yaml:"redir,omitempty"`
+	TProxyAddress  string   `yaml:"tproxy,omitempty"`
+	TProxyUDP      bool     `yaml:"tproxy-udp,omitempty"`
+	Sniff          bool     `yaml:"sniff,omitempty"`
+	SniffOverride  bool     `yaml:"sniff-override,omitempty"`
+	AuthUsers      []string `yaml:"auth-users,omitempty"`
+	AuthHtpasswd   string   `yaml:"auth-htpasswd,omitempty"`
+	AuthAllow      []string `yaml:"auth-allow,omitempty"`
+	MITMHosts      []string `yaml:"mitm-hosts,omitempty"`
+	MITMCACert     string   `yaml:"mitm-ca-cert,omitempty"`
+	MITMCAKey      string   `yaml:"mitm-ca-key,omitempty"`
+	Capture        bool     `yaml:"capture,omitempty"`
+	CaptureHosts   []string `yaml:"capture-hosts,omitempty"`
+	CaptureDir     string   `yaml:"capture-dir,omitempty"`
+	CaptureMaxBody int      `yaml:"capture-max-body,omitempty"`
+	Password       string   `yaml:"password,omitempty"`
+	PasswordFile   string   `yaml:"password-file,omitempty"`
+	Method         string   `yaml:"method,omitempty"`
+	Protocol       string   `yaml:"protocol,omitempty"`
+	AllowPlaintext bool     `yaml:"allow-plaintext,omitempty"`
+	LogLevel       string   `yaml:"log-level,omitempty"`
+	Transport      string   `yaml:"transport,omitempty"`
+
+	// MITMOriginRoots verify the origins of intercepted hosts, nil for the
+	// system roots; only settable in code
+	MITMOriginRoots *x509.CertPool `yaml:"-"`
+
+	// server side reuse of upstream conns for plain HTTP
+	PoolMaxIdlePerHost int `yaml:"pool-max-idle-per-host,omitempty"`
+	PoolMaxIdle        int `yaml:"pool-max-idle,omitempty"`
+
+	// IPPreference picks the address family of dialed hosts
+	IPPreference string `yaml:"ip-preference,omitempty"`
+	// Egress is a proxy url the server dials destinations through
+	Egress string `yaml:"egress,omitempty"`
+
+	// DNS configures how the server resolves destinations
+	DNS DNSConfig `yaml:"dns,omitempty"`
+
+	// Forwards are static tunnels opened by the client
+	Forwards []Forward `yaml:"forwards,omitempty"`
+	// Reverses are listened on the server and relayed to the client side,
+	// the server only allows them with the same token and on ReversePorts
+	Reverses          []Forward `yaml:"reverses,omitempty"`
+	ReverseToken      string    `yaml:"reverse-token,omitempty"`
+	ReversePorts      []string  `yaml:"reverse-ports,omitempty"`
+	ReverseMaxTunnels int       `yaml:"reverse-max-tunnels,omitempty"`
+	ReverseMaxConns   int       `yaml:"reverse-max-conns,omitempty"`
+
+	// Timeouts apply to both sides, overridden by ClientTimeouts or
+	// ServerTimeouts and then by the first matching rule
+	Timeouts       `yaml:",inline"`
+	ClientTimeouts Timeouts `yaml:"client-timeouts,omitempty"`
+	ServerTimeouts Timeouts `yaml:"server-timeouts,omitempty"`
+	Rules          []Rule   `yaml:"rules,omitempty"`
 }
 
-// NewConfig factory
+var errPasswordFile = errors.New("Password and password-file are exclusive")
+
+// NewConfig factory, an empty path gives an empty config
 func NewConfig(p string) (c *Config) {
 	c = &Config{}
+	if p == "" {
+		return
+	}
 	fd, err := os.Open(p)
 	defer fd.Close()
 	if os.IsNotExist(err) {
@@ -30,9 +164,322 @@ func NewConfig(p string) (c *Config) {
 	checkError(err)
 
 	err = yaml.Unmarshal(bytes, c)
+	if err == nil && c.Password != "" && c.PasswordFile != "" {
+		err = errPasswordFile
+	}
+	if err == nil && c.ServerURI != "" {
+		err = c.applyURI(c.ServerURI)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Invalid config: ", err.Error())
 		os.Exit(1)
 	}
 	return
 }
+
+// EnvName returns the environment variable overriding key
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(key, "-", "_", -1))
+}
+
+// Set assigns the config field named by key from its string form
+func (c *Config) Set(key, value string) (err error) {
+	switch key {
+	case "uri":
+		c.ServerURI = value
+		err = c.applyURI(value)
+	case "name":
+		c.Name = value
+	case "server":
+		c.ServerAddress = value
+	case "server-proxy":
+		c.ServerProxy = value
+	case "local":
+		c.LocalAddress = value
+	case "local-http2":
+		c.LocalHTTP2, err = strconv.ParseBool(value)
+	case "local-tls-cert":
+		c.LocalTLSCert = value
+	case "local-tls-key":
+		c.LocalTLSKey = value
+	case "socks":
+		c.SocksAddress = value
+	case "redir":
+		c.RedirAddress = value
+	case "tproxy":
+		c.TProxyAddress = value
+	case "tproxy-udp":
+		c.TProxyUDP, err = strconv.ParseBool(value)
+	case "sniff":
+		c.Sniff, err = strconv.ParseBool(value)
+	case "sniff-override":
+		c.SniffOverride, err = strconv.ParseBool(value)
+	case "auth-users":
+		c.AuthUsers = strings.Split(value, ",")
+	case "auth-htpasswd":
+		c.AuthHtpasswd = value
+	case "auth-allow":
+		c.AuthAllow = strings.Split(value, ",")
+	case "mitm-hosts":
+		c.MITMHosts = strings.Split(value, ",")
+	case "mitm-ca-cert":
+		c.MITMCACert = value
+	case "mitm-ca-key":
+		c.MITMCAKey = value
+	case "capture":
+		c.Capture, err = strconv.ParseBool(value)
+	case "capture-hosts":
+		c.CaptureHosts = strings.Split(value, ",")
+	case "capture-dir":
+		c.CaptureDir = value
+	case "capture-max-body":
+		c.CaptureMaxBody, err = strconv.Atoi(value)
+	case "forward":
+		c.Forwards, err = parseForwards(value)
+	case "reverse":
+		c.Reverses, err = parseForwards(value)
+	case "reverse-token":
+		c.ReverseToken = value
+	case "reverse-ports":
+		c.ReversePorts = strings.Split(value, ",")
+	case "reverse-max-tunnels":
+		c.ReverseMaxTunnels, err = strconv.Atoi(value)
+	case "reverse-max-conns":
+		c.ReverseMaxConns, err = strconv.Atoi(value)
+	case "password":
+		c.Password, c.PasswordFile = value, ""
+	case "password-file":
+		c.Password, c.PasswordFile = "", value
+	case "method":
+		c.Method = value
+	case "protocol":
+		c.Protocol = value
+	case "allow-plaintext":
+		c.AllowPlaintext, err = strconv.ParseBool(value)
+	case "log-level":
+		c.LogLevel = value
+	case "handshake-timeout":
+		c.Handshake, err = time.ParseDuration(value)
+	case "dial-timeout":
+		c.Dial, err = time.ParseDuration(value)
+	case "idle-timeout":
+		c.Idle, err = time.ParseDuration(value)
+	case "response-header-timeout":
+		c.ResponseHeader, err = time.ParseDuration(value)
+	case "idle-conn-timeout":
+		c.IdleConn, err = time.ParseDuration(value)
+	case "keepalive":
+		c.KeepAlive, err = time.ParseDuration(value)
+	case "pool-max-idle-per-host":
+		c.PoolMaxIdlePerHost, err = strconv.Atoi(value)
+	case "pool-max-idle":
+		c.PoolMaxIdle, err = strconv.Atoi(value)
+	case "ip-preference":
+		c.IPPreference = value
+	case "egress":
+		c.Egress = value
+	case "dns":
+		c.DNS.Upstreams = strings.Split(value, ",")
+	case "dns-listen":
+		c.DNS.Listen = value
+	case "transport":
+		c.Transport = value
+	default:
+		err = fmt.Errorf("Unknown config key: %s", key)
+	}
+	if err != nil {
+		err = fmt.Errorf("Invalid %s: %s", key, err)
+	}
+	return
+}
+
+// LoadEnv overrides fields with every GARROW_* variable present
+func (c *Config) LoadEnv() (err error) {
+	if _, ok := os.LookupEnv(EnvName("password")); ok {
+		if _, ok := os.LookupEnv(EnvName("password-file")); ok {
+			return fmt.Errorf("%s: %s", EnvName("password-file"), errPasswordFile)
+		}
+	}
+	for _, key := range ConfigKeys {
+		if v, ok := os.LookupEnv(EnvName(key)); ok {
+			if err = c.Set(key, v); err != nil {
+				return fmt.Errorf("%s: %s", EnvName(key), err)
+			}
+		}
+	}
+	return
+}
+
+// Check fills defaults, reads password-file into password
+// and validates the result
+func (c *Config) Check() (err error) {
+	if c.ServerAddress == "" && len(c.Servers) > 0 {
+		if err = c.pickServer(); err != nil {
+			return
+		}
+	}
+	if c.Transport == "" {
+		c.Transport = DefaultTransport
+	}
+	if c.Transport != DefaultTransport {
+		return fmt.Errorf("Unsupported transport: %s", c.Transport)
+	}
+	if c.Method == "" {
+		c.Method = DefaultMethod
+	}
+	m, ok := cipherMethods[c.Method]
+	if !ok {
+		return fmt.Errorf("Unsupported cipher method: %s", c.Method)
+	}
+	if c.Method == "none" && !c.AllowPlaintext && !isLoopback(c.ServerAddress) {
+		// no cipher means no password either, an open relay for anyone
+		return fmt.Errorf("Cipher method none neither encrypts nor authenticates, set allow-plaintext to use it on %s", c.ServerAddress)
+	}
+	if c.Protocol == "" {
+		c.Protocol = ProtocolGArrow
+	}
+	switch c.Protocol {
+	case ProtocolGArrow:
+		if m.aead {
+			return fmt.Errorf("Cipher method %s needs protocol %s", c.Method, ProtocolShadowsocks)
+		}
+	case ProtocolShadowsocks:
+		// shadowsocks tunnels only carry tcp to an address
+		if len(c.Reverses) > 0 || c.TProxyUDP || c.DNS.Listen != "" {
+			return fmt.Errorf("Protocol %s has no reverse, udp or dns tunnels", ProtocolShadowsocks)
+		}
+	default:
+		return fmt.Errorf("Unsupported protocol: %s", c.Protocol)
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = logrus.DebugLevel.String()
+	}
+	if _, err = logrus.ParseLevel(c.LogLevel); err != nil {
+		return
+	}
+	c.Timeouts = defaultTimeouts.merge(c.Timeouts)
+	if c.PoolMaxIdlePerHost == 0 {
+		c.PoolMaxIdlePerHost = DefaultPoolMaxIdlePerHost
+	}
+	if c.PoolMaxIdle == 0 {
+		c.PoolMaxIdle = DefaultPoolMaxIdle
+	}
+	switch c.IPPreference {
+	case "", IPv4Only, IPv6Only, PreferV4, PreferV6:
+	default:
+		return fmt.Errorf("Invalid ip-preference: %s", c.IPPreference)
+	}
+	if _, err = NewResolver(c.DNS); err != nil {
+		return
+	}
+	for _, s := range c.DNS.LocalUpstreams {
+		if _, err = newDNSUpstream(s); err != nil {
+			return
+		}
+	}
+	if (c.LocalTLSCert == "") != (c.LocalTLSKey == "") {
+		return fmt.Errorf("local-tls-cert and local-tls-key go together")
+	}
+	if c.LocalTLSCert != "" {
+		if _, err = tls.LoadX509KeyPair(c.LocalTLSCert, c.LocalTLSKey); err != nil {
+			return
+		}
+	}
+	if _, err = NewProxyAuth(c); err != nil {
+		return
+	}
+	if c.ServerProxy != "" && len(c.AuthUsers) == 0 && c.AuthHtpasswd == "" && len(c.AuthAllow) == 0 {
+		return fmt.Errorf("config.server-proxy needs auth-users, auth-htpasswd or auth-allow")
+	}
+	if c.Egress != "" {
+		if _, err = parseEgress(c.Egress); err != nil {
+			return
+		}
+	}
+	if _, err = newMITM(c); err != nil {
+		return
+	}
+	if c.SniffOverride && !c.Sniff {
+		return fmt.Errorf("config.sniff-override needs sniff")
+	}
+	if c.Capture && len(c.CaptureHosts) == 0 {
+		return fmt.Errorf("config.capture needs capture-hosts")
+	}
+	if len(c.CaptureHosts) > 0 && c.CaptureDir == "" {
+		return fmt.Errorf("config.capture-hosts needs capture-dir")
+	}
+	if c.CaptureMaxBody == 0 {
+		c.CaptureMaxBody = DefaultCaptureMaxBody
+	}
+	for _, f := range append(c.Forwards, c.Reverses...) {
+		if err = f.check(); err != nil {
+			return
+		}
+	}
+	for _, p := range c.ReversePorts {
+		if _, _, err = parsePortRange(p); err != nil {
+			return
+		}
+	}
+	if c.ReverseMaxTunnels == 0 {
+		c.ReverseMaxTunnels = DefaultReverseMaxTunnels
+	}
+	if c.ReverseMaxConns == 0 {
+		c.ReverseMaxConns = DefaultReverseMaxConns
+	}
+	for _, r := range c.Rules {
+		if len(r.Hosts) == 0 {
+			return fmt.Errorf("config.rules: every rule needs hosts")
+		}
+		switch r.Action {
+		case "", ActionProxy, ActionDirect:
+		default:
+			return fmt.Errorf("config.rules: invalid action %s", r.Action)
+		}
+	}
+	if c.PasswordFile != "" {
+		var b []byte
+		if b, err = ioutil.ReadFile(c.PasswordFile); err != nil {
+			return
+		}
+		c.Password = strings.TrimSpace(string(b))
+	}
+	return
+}
+
+// forSide returns a copy of c with the side specific timeouts applied
+func (c *Config) forSide(side Timeouts) *Config {
+	cc := *c
+	cc.Timeouts = c.Timeouts.merge(side)
+	return &cc
+}
+
+// Marshal dumps the config as YAML, secrets included
+func (c *Config) Marshal() ([]byte, error) {
+	return yaml.Marshal(c)
+}
+
+// String dumps the config as YAML with secrets redacted
+func (c *Config) String() string {
+	cc := *c
+	if cc.Password != "" {
+		cc.Password = redacted
+	}
+	if cc.ReverseToken != "" {
+		cc.ReverseToken = redacted
+	}
+	cc.AuthUsers = make([]string, len(c.AuthUsers))
+	for i, u := range c.AuthUsers {
+		cc.AuthUsers[i] = strings.SplitN(u, ":", 2)[0] + ":" + redacted
+	}
+	cc.ServerURI = redactURI(cc.ServerURI)
+	cc.Servers = make([]string, len(c.Servers))
+	for i, s := range c.Servers {
+		cc.Servers[i] = redactURI(s)
+	}
+	b, err := cc.Marshal()
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
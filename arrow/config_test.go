@@ -0,0 +1,71 @@
+package arrow
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "garrow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "password")
+	if err = ioutil.WriteFile(p, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the yaml password is replaced by a later password-file
+	c := &Config{Password: "from-yaml"}
+	if err = c.Set("password-file", p); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Password != "from-file" {
+		t.Errorf("password = %q, want from-file", c.Password)
+	}
+
+	// and a later password replaces the password-file
+	c = &Config{PasswordFile: p}
+	if err = c.Set("password", "from-flag"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Password != "from-flag" {
+		t.Errorf("password = %q, want from-flag", c.Password)
+	}
+
+	os.Setenv(EnvName("password"), "from-env")
+	os.Setenv(EnvName("password-file"), p)
+	defer os.Unsetenv(EnvName("password"))
+	defer os.Unsetenv(EnvName("password-file"))
+	if err = (&Config{}).LoadEnv(); err == nil {
+		t.Error("both password envs were accepted")
+	}
+}
+
+func TestMethodNone(t *testing.T) {
+	for _, c := range []struct {
+		server string
+		allow  bool
+		ok     bool
+	}{
+		{"127.0.0.1:9999", false, true},
+		{"[::1]:9999", false, true},
+		{"0.0.0.0:9999", false, false},
+		{"example.com:9999", false, false},
+		{"0.0.0.0:9999", true, true},
+	} {
+		err := (&Config{ServerAddress: c.server, Method: "none", AllowPlaintext: c.allow}).Check()
+		if (err == nil) != c.ok {
+			t.Errorf("%s allow-plaintext %v: got %v", c.server, c.allow, err)
+		}
+	}
+}
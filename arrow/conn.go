@@ -11,6 +11,11 @@ import (
 
 const (
 	IDLE_TIMEOUT = 60 * time.Second
+	DIAL_TIMEOUT = 5 * time.Second
+
+	// spliceChunk is how much is relayed without encryption between two
+	// idle deadline refreshes
+	spliceChunk = 64 * 1024
 )
 
 func NewArrowConn(conn net.Conn, cipher *Cipher, timeout time.Duration) (c *ArrowConn) {
@@ -19,6 +24,7 @@ func NewArrowConn(conn net.Conn, cipher *Cipher, timeout time.Duration) (c *Arro
 		timeout: timeout,
 		mu:      &sync.Mutex{},
 		cipher:  cipher,
+		disable: cipher.block == nil,
 	}
 	if timeout > 0 {
 		c.SetDeadline(time.Now().Add(timeout))
@@ -34,6 +40,10 @@ type ArrowConn struct {
 	mu      *sync.Mutex
 	cipher  *Cipher
 	disable bool
+	// shadowsocks conns send a socks address instead of the garrow header
+	shadowsocks bool
+	// replay is the server's filter of seen IVs, nil on the client
+	replay *replayFilter
 }
 
 func (c *ArrowConn) Read(b []byte) (n int, err error) {
@@ -41,10 +51,17 @@ func (c *ArrowConn) Read(b []byte) (n int, err error) {
 		if c.cipher.decer == nil {
 			iv := make([]byte, aes.BlockSize)
 			n, err := io.ReadFull(c.Conn, iv)
+			if n == 0 && err == io.EOF {
+				// peer half-closed without sending anything
+				return 0, io.EOF
+			}
 			if n != aes.BlockSize || err != nil {
 				err = fmt.Errorf("Error read cipher: %d, %s", n, err)
 				return 0, err
 			}
+			if !c.replay.add(iv) {
+				return 0, errReplayed
+			}
 			c.cipher.initDecer(iv)
 		}
 	}
@@ -57,6 +74,9 @@ func (c *ArrowConn) Read(b []byte) (n int, err error) {
 			}
 		}
 	}
+	if n == 0 {
+		return
+	}
 	if c.timeout > 0 {
 		c.SetDeadline(time.Now().Add(c.timeout))
 	}
@@ -67,25 +87,129 @@ func (c *ArrowConn) Read(b []byte) (n int, err error) {
 }
 
 func (c *ArrowConn) Write(b []byte) (n int, err error) {
-	if !c.disable {
-		if c.cipher.encer == nil {
-			iv := c.cipher.initEncer()
-			c.Conn.Write(iv)
+	if c.disable {
+		return c.write(b)
+	}
+	if err = c.ensureEncer(); err != nil {
+		return
+	}
+
+	buf := getBuf()
+	defer putBuf(buf)
+	for n < len(b) {
+		m := copy(*buf, b[n:])
+		c.cipher.encer.XORKeyStream((*buf)[:m], (*buf)[:m])
+		var w int
+		w, err = c.write((*buf)[:m])
+		n += w
+		if err != nil {
+			return
 		}
 	}
+	return
+}
 
+// ReadFrom encrypts r in place in a pooled buffer. Without encryption it
+// hands over to the underlying conn, e.g. splice(2) between tcp conns.
+func (c *ArrowConn) ReadFrom(r io.Reader) (n int64, err error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok && c.disable {
+		return c.chunked(func() (int64, error) {
+			return rf.ReadFrom(&io.LimitedReader{R: r, N: spliceChunk})
+		})
+	}
 	if !c.disable {
-		n, err = c.Conn.Write(c.cipher.Encrypt(b))
-	} else {
-		n, err = c.Conn.Write(b)
+		if err = c.ensureEncer(); err != nil {
+			return
+		}
 	}
-	if err != nil {
-		if nerr, ok := err.(net.Error); ok {
-			if !nerr.Temporary() || nerr.Timeout() {
-				c.Close()
-				return
+
+	buf := getBuf()
+	defer putBuf(buf)
+	for {
+		nr, er := r.Read(*buf)
+		if nr > 0 {
+			if !c.disable {
+				c.cipher.encer.XORKeyStream((*buf)[:nr], (*buf)[:nr])
+			}
+			nw, ew := c.write((*buf)[:nr])
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+		}
+		if er == io.EOF {
+			return n, nil
+		}
+		if er != nil {
+			return n, er
+		}
+	}
+}
+
+// WriteTo decrypts in place in a pooled buffer, or without encryption lets
+// w read the underlying conn directly
+func (c *ArrowConn) WriteTo(w io.Writer) (n int64, err error) {
+	if c.disable {
+		buf := getBuf()
+		defer putBuf(buf)
+		return c.chunked(func() (int64, error) {
+			return io.CopyBuffer(w, &io.LimitedReader{R: c.Conn, N: spliceChunk}, *buf)
+		})
+	}
+
+	buf := getBuf()
+	defer putBuf(buf)
+	for {
+		nr, er := c.Read(*buf)
+		if nr > 0 {
+			nw, ew := w.Write((*buf)[:nr])
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
 			}
 		}
+		if er == io.EOF {
+			return n, nil
+		}
+		if er != nil {
+			return n, er
+		}
+	}
+}
+
+// chunked repeats copying up to spliceChunk bytes until a short copy means
+// EOF, refreshing the idle deadline in between
+func (c *ArrowConn) chunked(copyChunk func() (int64, error)) (n int64, err error) {
+	for {
+		m, err := copyChunk()
+		n += m
+		if err != nil {
+			return n, c.checkError(err)
+		}
+		if c.timeout > 0 {
+			c.SetDeadline(time.Now().Add(c.timeout))
+		}
+		if m < spliceChunk {
+			return n, nil
+		}
+	}
+}
+
+func (c *ArrowConn) ensureEncer() (err error) {
+	if c.cipher.encer != nil {
+		return
+	}
+	iv := c.cipher.initEncer()
+	c.replay.add(iv)
+	_, err = c.write(iv)
+	return
+}
+
+// write sends b as is and refreshes the idle deadline
+func (c *ArrowConn) write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if err != nil {
+		return n, c.checkError(err)
 	}
 	if c.timeout > 0 {
 		c.SetDeadline(time.Now().Add(c.timeout))
@@ -93,6 +217,22 @@ func (c *ArrowConn) Write(b []byte) (n int, err error) {
 	return
 }
 
+// checkError closes the conn on fatal errors
+func (c *ArrowConn) checkError(err error) error {
+	if nerr, ok := err.(net.Error); ok {
+		if !nerr.Temporary() || nerr.Timeout() {
+			c.Close()
+		}
+	}
+	return err
+}
+
+// CloseWrite half-closes the underlying conn, the stream cipher needs no
+// trailer so the peer simply reads EOF
+func (c *ArrowConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
 func (c *ArrowConn) SetTimeout(t time.Duration) {
 	c.timeout = t
 	if t > 0 {
@@ -0,0 +1,193 @@
+package arrow
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Values of config.ip-preference, empty keeps the resolver order
+const (
+	IPv4Only = "ipv4-only"
+	IPv6Only = "ipv6-only"
+	PreferV4 = "prefer-v4"
+	PreferV6 = "prefer-v6"
+)
+
+// fallbackDelay is how long the preferred family gets before the other one
+// is tried in parallel, as RFC 6555 suggests
+const fallbackDelay = 300 * time.Millisecond
+
+// Dialer connects to host:port destinations following an ip preference,
+// racing both families Happy Eyeballs style
+type Dialer struct {
+	Preference string
+	KeepAlive  time.Duration
+	// LookupIP resolves host names, net.DefaultResolver when nil
+	LookupIP func(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// NewDialer returns the dialer c asks for
+func NewDialer(c *Config) *Dialer {
+	return &Dialer{
+		Preference: c.IPPreference,
+		KeepAlive:  c.KeepAlive,
+	}
+}
+
+// Dial matches ConnPool.Dial, network is ignored in favor of the preference
+func (d *Dialer) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// DialContext resolves address and dials its ips
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	primaries, fallbacks := d.partition(ips)
+	if len(primaries) == 0 {
+		return nil, fmt.Errorf("No %s address for %s", d.Preference, host)
+	}
+	return d.dialParallel(ctx, primaries, fallbacks, port)
+}
+
+func (d *Dialer) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if d.LookupIP != nil {
+		return d.LookupIP(ctx, host)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+// partition splits ips into the family tried first and the fallback one
+func (d *Dialer) partition(ips []net.IP) (primaries, fallbacks []net.IP) {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch d.Preference {
+	case IPv4Only:
+		return v4, nil
+	case IPv6Only:
+		return v6, nil
+	case PreferV4:
+		if len(v4) == 0 {
+			return v6, nil
+		}
+		return v4, v6
+	case PreferV6:
+		if len(v6) == 0 {
+			return v4, nil
+		}
+		return v6, v4
+	}
+	if len(ips) > 0 && ips[0].To4() != nil {
+		return v4, v6
+	}
+	if len(v6) == 0 {
+		return v4, nil
+	}
+	return v6, v4
+}
+
+type dialResult struct {
+	net.Conn
+	error
+	primary bool
+}
+
+// dialParallel starts the fallbacks fallbackDelay after the primaries, or
+// as soon as the primaries failed, and returns the first conn established
+func (d *Dialer) dialParallel(ctx context.Context, primaries, fallbacks []net.IP, port string) (net.Conn, error) {
+	if len(fallbacks) == 0 {
+		return d.dialSerial(ctx, primaries, port)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult)
+	race := func(ips []net.IP, primary bool) {
+		c, err := d.dialSerial(ctx, ips, port)
+		select {
+		case results <- dialResult{c, err, primary}:
+		case <-ctx.Done():
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+	go race(primaries, true)
+
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+	var firstErr error
+	pending, fallbackStarted := 1, false
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallbacks, false)
+			}
+		case res := <-results:
+			pending--
+			if res.error == nil {
+				return res.Conn, nil
+			}
+			if firstErr == nil || res.primary {
+				firstErr = res.error
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallbacks, false)
+			}
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// dialSerial tries ips one after another
+func (d *Dialer) dialSerial(ctx context.Context, ips []net.IP, port string) (c net.Conn, err error) {
+	nd := &net.Dialer{KeepAlive: d.KeepAlive}
+	for _, ip := range ips {
+		c, err = nd.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,70 @@
+package arrow
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestEnsurePort(t *testing.T) {
+	for in, want := range map[string]string{
+		"example.com":        "example.com:80",
+		"example.com:443":    "example.com:443",
+		"1.2.3.4":            "1.2.3.4:80",
+		"::1":                "[::1]:80",
+		"[::1]":              "[::1]:80",
+		"[::1]:443":          "[::1]:443",
+		"2001:db8::1":        "[2001:db8::1]:80",
+		"[2001:db8::1]:8080": "[2001:db8::1]:8080",
+	} {
+		if got := ensurePort(in); got != want {
+			t.Errorf("%s: want %s, got %s", in, want, got)
+		}
+	}
+}
+
+func TestDialerPartition(t *testing.T) {
+	v4, v6 := net.ParseIP("1.2.3.4"), net.ParseIP("::1")
+	ips := []net.IP{v6, v4}
+	for pref, want := range map[string][2][]net.IP{
+		"":       {{v6}, {v4}},
+		IPv4Only: {{v4}, nil},
+		IPv6Only: {{v6}, nil},
+		PreferV4: {{v4}, {v6}},
+		PreferV6: {{v6}, {v4}},
+	} {
+		d := &Dialer{Preference: pref}
+		p, f := d.partition(ips)
+		if !reflect.DeepEqual([2][]net.IP{p, f}, want) {
+			t.Errorf("%q: want %v, got %v %v", pref, want, p, f)
+		}
+	}
+}
+
+func TestDialerFallback(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// nothing listens on ::1 with that port, so v6 fails and v4 wins
+	d := &Dialer{
+		Preference: PreferV6,
+		LookupIP: func(context.Context, string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}, nil
+		},
+	}
+	c, err := d.Dial("tcp", net.JoinHostPort("dual.test", port), DIAL_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	d.Preference = IPv6Only
+	if _, err := d.Dial("tcp", net.JoinHostPort("dual.test", port), DIAL_TIMEOUT); err == nil {
+		t.Error("ipv6-only should not fall back to v4")
+	}
+}
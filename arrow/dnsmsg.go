@@ -0,0 +1,227 @@
+package arrow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DNS record types and response codes used by the resolver
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeSOA   = 6
+	dnsTypeAAAA  = 28
+	dnsClassINET = 1
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+
+	dnsHeaderLen = 12
+)
+
+var errDNSMsg = errors.New("Malformed dns message")
+
+// dnsQuestion is the single question of a query
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+	class uint16
+}
+
+// dnsAnswer is what the resolver keeps of a response
+type dnsAnswer struct {
+	ips   []net.IP
+	ttl   uint32
+	rcode int
+}
+
+// buildDNSQuery encodes a recursive query for name
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, dnsHeaderLen, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	msg[2] = 0x01 // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	msg, err := appendDNSName(msg, name)
+	if err != nil {
+		return nil, err
+	}
+	msg = append(msg, byte(qtype>>8), byte(qtype), 0, dnsClassINET)
+	return msg, nil
+}
+
+func appendDNSName(msg []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("Invalid dns name: %s", name)
+			}
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+	}
+	return append(msg, 0), nil
+}
+
+// buildDNSResponse answers query with ips, all of the question type
+func buildDNSResponse(query []byte, ips []net.IP, ttl uint32, rcode int) ([]byte, error) {
+	_, q, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, dnsHeaderLen, 512)
+	copy(msg, query[:4])
+	msg[2] |= 0x80                   // QR
+	msg[3] = 0x80 | byte(rcode&0x0F) // RA
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	if msg, err = appendDNSName(msg, q.name); err != nil {
+		return nil, err
+	}
+	msg = append(msg, byte(q.qtype>>8), byte(q.qtype), byte(q.class>>8), byte(q.class))
+
+	var an uint16
+	for _, ip := range ips {
+		rdata := ip.To4()
+		if q.qtype == dnsTypeAAAA {
+			rdata = ip.To16()
+			if ip.To4() != nil {
+				rdata = nil
+			}
+		}
+		if rdata == nil {
+			continue
+		}
+		// name points back to the question
+		msg = append(msg, 0xC0, dnsHeaderLen, byte(q.qtype>>8), byte(q.qtype), byte(q.class>>8), byte(q.class),
+			byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl), byte(len(rdata)>>8), byte(len(rdata)))
+		msg = append(msg, rdata...)
+		an++
+	}
+	binary.BigEndian.PutUint16(msg[6:], an)
+	return msg, nil
+}
+
+// readDNSName decodes the possibly compressed name at off, returning it
+// and the offset right after it in msg
+func readDNSName(msg []byte, off int) (name string, next int, err error) {
+	var labels []string
+	next = -1
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 127 {
+			return "", 0, errDNSMsg
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSMsg
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSMsg
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// parseDNSQuestion reads the header id and the first question of msg
+func parseDNSQuestion(msg []byte) (id uint16, q dnsQuestion, err error) {
+	if len(msg) < dnsHeaderLen || binary.BigEndian.Uint16(msg[4:]) == 0 {
+		return 0, q, errDNSMsg
+	}
+	id = binary.BigEndian.Uint16(msg)
+	name, off, err := readDNSName(msg, dnsHeaderLen)
+	if err != nil {
+		return
+	}
+	if off+4 > len(msg) {
+		return 0, q, errDNSMsg
+	}
+	q = dnsQuestion{
+		name:  name,
+		qtype: binary.BigEndian.Uint16(msg[off:]),
+		class: binary.BigEndian.Uint16(msg[off+2:]),
+	}
+	return
+}
+
+// parseDNSAnswer collects the addresses of a response with the smallest ttl
+// of the qtype records along the answer chain. Negative answers take their ttl from
+// the authority SOA, as RFC 2308 says.
+func parseDNSAnswer(msg []byte, qtype uint16) (a *dnsAnswer, err error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, errDNSMsg
+	}
+	a = &dnsAnswer{rcode: int(msg[3] & 0x0F)}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	an := int(binary.BigEndian.Uint16(msg[6:]))
+	ns := int(binary.BigEndian.Uint16(msg[8:]))
+
+	off := dnsHeaderLen
+	for i := 0; i < qd; i++ {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return
+		}
+		off += 4
+	}
+
+	minTTL := ^uint32(0)
+	for i := 0; i < an+ns; i++ {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return
+		}
+		if off+10 > len(msg) {
+			return nil, errDNSMsg
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, errDNSMsg
+		}
+		rdata := msg[off : off+rdlen]
+		off += rdlen
+
+		if i >= an {
+			if rtype == dnsTypeSOA && rdlen >= 20 && len(a.ips) == 0 {
+				if m := binary.BigEndian.Uint32(rdata[rdlen-4:]); m < ttl {
+					ttl = m
+				}
+				if ttl < minTTL {
+					minTTL = ttl
+				}
+			}
+			continue
+		}
+		if rtype != qtype && rtype != dnsTypeCNAME {
+			continue
+		}
+		if rtype == dnsTypeA && rdlen == net.IPv4len || rtype == dnsTypeAAAA && rdlen == net.IPv6len {
+			a.ips = append(a.ips, net.IP(append([]byte(nil), rdata...)))
+		}
+		if ttl < minTTL {
+			minTTL = ttl
+		}
+	}
+	if minTTL != ^uint32(0) {
+		a.ttl = minTTL
+	}
+	return
+}
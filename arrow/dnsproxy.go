@@ -0,0 +1,287 @@
+package arrow
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// dnsTunnelHost is sent instead of a destination to open a tunnel carrying
+// length prefixed dns messages, answered by the server's resolver
+const dnsTunnelHost = "dns:"
+
+var errDNSTunnelClosed = errors.New("dns tunnel closed")
+
+// handleDNS answers the queries of a dns tunnel concurrently
+func (s *Server) handleDNS(cConn net.Conn) {
+	setIdle(cConn, s.Idle)
+	var mu sync.Mutex
+	for {
+		q, err := readFrame(cConn)
+		if err != nil {
+			return
+		}
+		go func() {
+			res, err := s.resolver.Answer(context.Background(), q)
+			if err != nil {
+				s.logger.Debugln("Error answering dns query: ", err)
+				if res, err = buildDNSResponse(q, nil, 0, dnsRcodeServFail); err != nil {
+					return
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			writeFrame(cConn, res)
+		}()
+	}
+}
+
+// dnsTunnel multiplexes queries over one tunnel, renumbering them so
+// responses can come back in any order
+type dnsTunnel struct {
+	config *Config
+
+	mu      sync.Mutex
+	conn    net.Conn
+	nextID  uint16
+	pending map[uint16]chan []byte
+}
+
+// Exchange sends query through the tunnel and waits for its response
+func (t *dnsTunnel) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < dnsHeaderLen {
+		return nil, errDNSMsg
+	}
+	ch := make(chan []byte, 1)
+	q := append([]byte(nil), query...)
+
+	t.mu.Lock()
+	if t.conn == nil {
+		if err := t.dial(); err != nil {
+			t.mu.Unlock()
+			return nil, err
+		}
+	}
+	t.nextID++
+	id := t.nextID
+	t.pending[id] = ch
+	binary.BigEndian.PutUint16(q, id)
+	err := writeFrame(t.conn, q)
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, id)
+		t.mu.Unlock()
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return nil, errDNSTunnelClosed
+		}
+		copy(res, query[:2])
+		return res, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dial must be called with t.mu held
+func (t *dnsTunnel) dial() error {
+	c, err := Dial("tcp", t.config)
+	if err != nil {
+		return err
+	}
+	if err = sendHost(c, dnsTunnelHost); err != nil {
+		c.Close()
+		return err
+	}
+	t.conn = c
+	t.pending = make(map[uint16]chan []byte)
+	go t.read(c)
+	return nil
+}
+
+// read dispatches responses until c fails, then fails every pending query
+func (t *dnsTunnel) read(c net.Conn) {
+	for {
+		res, err := readFrame(c)
+		if err != nil || len(res) < dnsHeaderLen {
+			break
+		}
+		// taken out at once, so a duplicate or late response finds no one
+		// and the buffered send never blocks
+		id := binary.BigEndian.Uint16(res)
+		t.mu.Lock()
+		ch, ok := t.pending[id]
+		delete(t.pending, id)
+		t.mu.Unlock()
+		if ok {
+			ch <- res
+		}
+	}
+	c.Close()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == c {
+		t.conn = nil
+		for id, ch := range t.pending {
+			close(ch)
+			delete(t.pending, id)
+		}
+	}
+}
+
+// DNSProxy serves dns on the client, names under config.dns.local and
+// static hosts are resolved locally, everything else by the server
+type DNSProxy struct {
+	local       *Resolver
+	remote      *dnsTunnel
+	domains     []string
+	logger      *logrus.Logger
+	cache       *dnsCache
+	negativeTTL time.Duration
+}
+
+// NewDNSProxy returns the dns proxy of a client config
+func NewDNSProxy(c *Config, logger *logrus.Logger) (p *DNSProxy, err error) {
+	local, err := NewResolver(DNSConfig{
+		Upstreams:   c.DNS.LocalUpstreams,
+		Hosts:       c.DNS.Hosts,
+		NegativeTTL: c.DNS.NegativeTTL,
+		Timeout:     c.DNS.Timeout,
+	})
+	if err != nil {
+		return
+	}
+	p = &DNSProxy{
+		local:       local,
+		remote:      &dnsTunnel{config: c},
+		domains:     c.DNS.Local,
+		logger:      logger,
+		cache:       newDNSCache(c.DNS.CacheSize),
+		negativeTTL: local.negativeTTL,
+	}
+	return
+}
+
+// Answer responds to a raw query
+func (p *DNSProxy) Answer(ctx context.Context, query []byte) ([]byte, error) {
+	_, q, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.name, "."))
+	if _, ok := p.local.hosts[name]; ok || p.isLocal(name) {
+		return p.local.Answer(ctx, query)
+	}
+
+	key := dnsCacheKey{name, q.qtype}
+	if e := p.cache.get(key); e != nil {
+		res := append([]byte(nil), e.msg...)
+		copy(res, query[:2])
+		return res, nil
+	}
+
+	res, err := p.remote.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if a, err := parseDNSAnswer(res, q.qtype); err == nil {
+		ttl := time.Duration(a.ttl) * time.Second
+		if a.rcode != dnsRcodeSuccess && a.rcode != dnsRcodeNXDomain {
+			ttl = 0
+		} else if len(a.ips) == 0 && ttl == 0 {
+			ttl = p.negativeTTL
+		}
+		if ttl > 0 {
+			p.cache.put(key, &dnsCacheEntry{msg: res, expires: time.Now().Add(ttl)})
+		}
+	}
+	return res, nil
+}
+
+func (p *DNSProxy) isLocal(name string) bool {
+	for _, d := range p.domains {
+		if matchHost(d, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerOrFail always has a response, SERVFAIL when Answer fails
+func (p *DNSProxy) answerOrFail(query []byte) []byte {
+	res, err := p.Answer(context.Background(), query)
+	if err != nil {
+		p.logger.Debugln("Error answering dns query: ", err)
+		res, _ = buildDNSResponse(query, nil, 0, dnsRcodeServFail)
+	}
+	return res
+}
+
+// ServeUDP answers queries received on c
+func (p *DNSProxy) ServeUDP(c net.PacketConn) error {
+	for {
+		buf := make([]byte, dnsMaxUDPSize)
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if res := p.answerOrFail(buf[:n]); res != nil {
+				c.WriteTo(res, from)
+			}
+		}()
+	}
+}
+
+// ServeTCP answers length prefixed queries of conns accepted from l
+func (p *DNSProxy) ServeTCP(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			for {
+				c.SetDeadline(time.Now().Add(IDLE_TIMEOUT))
+				q, err := readFrame(c)
+				if err != nil {
+					return
+				}
+				res := p.answerOrFail(q)
+				if res == nil || writeFrame(c, res) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// ListenAndServe serves both udp and tcp on address
+func (p *DNSProxy) ListenAndServe(address string) error {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	go p.ServeTCP(l)
+	return p.ServeUDP(pc)
+}
@@ -0,0 +1,155 @@
+package arrow
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// egressDialer connects the server to destinations through the proxy of
+// config.egress, a socks5:// or http:// url with optional credentials
+type egressDialer struct {
+	proxy  *url.URL
+	dialer *Dialer
+}
+
+// parseEgress checks an egress proxy url
+func parseEgress(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, fmt.Errorf("Unsupported egress proxy %s, want socks5:// or http://", redactURI(s))
+	}
+	if _, _, err = net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("Invalid egress proxy address %s: %s", u.Host, err)
+	}
+	return u, nil
+}
+
+// newEgressDialer returns the egress c asks for, nil when it asks for none.
+// The proxy itself is dialed with dialer.
+func newEgressDialer(c *Config, dialer *Dialer) (*egressDialer, error) {
+	if c.Egress == "" {
+		return nil, nil
+	}
+	u, err := parseEgress(c.Egress)
+	if err != nil {
+		return nil, err
+	}
+	return &egressDialer{proxy: u, dialer: dialer}, nil
+}
+
+// Dial matches ConnPool.Dial, the destination is resolved by the proxy
+func (e *egressDialer) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := e.dialer.Dial(network, e.proxy.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if e.proxy.Scheme == "socks5" {
+		err = e.socksConnect(conn, address)
+	} else {
+		conn, err = e.httpConnect(conn, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socksConnect asks for a tunnel to address, with username and password
+// when the url has some
+func (e *egressDialer) socksConnect(conn net.Conn, address string) error {
+	method := byte(socksMethodNoAuth)
+	if e.proxy.User != nil {
+		method = socksMethodUserPass
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	if b[0] != socksVersion || b[1] != method {
+		return fmt.Errorf("Egress proxy refused socks auth method %d", method)
+	}
+	if method == socksMethodUserPass {
+		user := e.proxy.User.Username()
+		password, _ := e.proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return fmt.Errorf("Egress proxy credentials too long")
+		}
+		msg := append([]byte{socksUserPassVersion, byte(len(user))}, user...)
+		msg = append(append(msg, byte(len(password))), password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		if b[0] != socksUserPassVersion || b[1] != 0 {
+			return fmt.Errorf("Egress proxy rejected the credentials of %s", user)
+		}
+	}
+
+	req, err := appendSocksAddr([]byte{socksVersion, socksCmdConnect, 0}, address)
+	if err != nil {
+		return err
+	}
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+	b = make([]byte, 3)
+	if _, err = io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	if b[0] != socksVersion {
+		return fmt.Errorf("Egress proxy replied with socks version %d", b[0])
+	}
+	if b[1] != socksRepSucceeded {
+		return fmt.Errorf("Egress proxy failed connecting %s: socks reply %d", address, b[1])
+	}
+	_, err = readSocksAddr(conn)
+	return err
+}
+
+// httpConnect asks for a tunnel to address with a CONNECT request, the
+// conn returned keeps what the proxy sent past its response
+func (e *egressDialer) httpConnect(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if e.proxy.User != nil {
+		password, _ := e.proxy.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(e.proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("Egress proxy failed connecting %s: %s", address, res.Status)
+	}
+	return &bufferedConn{conn, br}, nil
+}
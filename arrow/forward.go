@@ -0,0 +1,47 @@
+package arrow
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Forward is a static tunnel, like ssh -L: conns accepted on Listen are
+// relayed through the server to To
+type Forward struct {
+	Listen string `yaml:"listen"`
+	To     string `yaml:"to"`
+}
+
+func (f Forward) check() error {
+	if _, _, err := net.SplitHostPort(f.Listen); err != nil {
+		return fmt.Errorf("Invalid forward listen address %s: %s", f.Listen, err)
+	}
+	if _, _, err := net.SplitHostPort(f.To); err != nil {
+		return fmt.Errorf("Invalid forward destination %s: %s", f.To, err)
+	}
+	return nil
+}
+
+// parseForwards reads the listen=to,listen=to form of env and flags
+func parseForwards(s string) (fs []Forward, err error) {
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid forward %s, want listen=host:port", spec)
+		}
+		fs = append(fs, Forward{Listen: spec[:i], To: spec[i+1:]})
+	}
+	return
+}
+
+// ServeForward relays every conn accepted from l to the fixed destination to
+func (c *Client) ServeForward(l net.Listener, to string) error {
+	return c.serveTunnels(l, func(net.Conn) (string, error) {
+		return to, nil
+	}, false)
+}
@@ -0,0 +1,70 @@
+package arrow
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseForwards(t *testing.T) {
+	fs, err := parseForwards("127.0.0.1:15432=db.internal:5432, [::1]:8080=[2001:db8::1]:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Forward{
+		{"127.0.0.1:15432", "db.internal:5432"},
+		{"[::1]:8080", "[2001:db8::1]:80"},
+	}
+	if len(fs) != len(want) {
+		t.Fatal("got", fs)
+	}
+	for i := range want {
+		if fs[i] != want[i] || fs[i].check() != nil {
+			t.Errorf("got %v, want %v", fs[i], want[i])
+		}
+	}
+	if _, err := parseForwards("127.0.0.1:15432"); err == nil {
+		t.Error("forward without destination should fail")
+	}
+	if err := (Forward{"127.0.0.1:15432", "db.internal"}).check(); err == nil {
+		t.Error("destination without port should fail")
+	}
+}
+
+func TestServeForward(t *testing.T) {
+	cc, _, stop := startArrow(t, &Config{})
+	defer stop()
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	go func() {
+		c, err := origin.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go NewClient(cc).(*Client).ServeForward(l, origin.Addr().String())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatal("no echo", string(b), err)
+	}
+}
@@ -0,0 +1,86 @@
+package arrow
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// protocols are those the client's local listener speaks: HTTP/1, HTTP/2
+// negotiated by ALPN when serving TLS, and prior knowledge h2c on request
+func (c *Client) protocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(c.LocalTLSCert != "")
+	p.SetUnencryptedHTTP2(c.LocalHTTP2)
+	return p
+}
+
+// streamConn is an HTTP/2 stream seen as a conn, reading the request body
+// and writing the response, so CONNECT tunnels can share one client conn
+type streamConn struct {
+	io.ReadCloser
+	w       io.Writer
+	flusher http.Flusher
+	local   net.Addr
+	remote  net.Addr
+}
+
+// newStreamConn sends the response header of r, the tunnel being established
+func newStreamConn(w http.ResponseWriter, r *http.Request) *streamConn {
+	c := &streamConn{
+		ReadCloser: r.Body,
+		w:          w,
+		remote:     streamAddr(r.RemoteAddr),
+	}
+	c.flusher, _ = w.(http.Flusher)
+	c.local, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if c.flusher != nil {
+		c.flusher.Flush()
+	}
+	return c
+}
+
+// Write flushes every write, the stream carries interactive protocols
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err == nil && c.flusher != nil {
+		c.flusher.Flush()
+	}
+	return n, err
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+// deadlines are left to the HTTP/2 server and the tunnel's idle timeout
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tcp" }
+func (a streamAddr) String() string  { return string(a) }
+
+// extendedConnect turns an RFC 8441 CONNECT, which opens e.g. a WebSocket
+// over an HTTP/2 stream, into the HTTP/1.1 handshake origins expect. It
+// returns the protocol to upgrade to, empty for a classic CONNECT.
+func extendedConnect(r *http.Request) string {
+	protocol := r.Header.Get(":protocol")
+	if r.Method != "CONNECT" || r.ProtoMajor != 2 || protocol == "" {
+		return ""
+	}
+	r.Header.Del(":protocol")
+	r.Method = "GET"
+	if strings.EqualFold(protocol, "websocket") && r.Header.Get("Sec-WebSocket-Key") == "" {
+		key := make([]byte, 16)
+		rand.Read(key)
+		r.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	}
+	return protocol
+}
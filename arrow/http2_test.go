@@ -0,0 +1,188 @@
+package arrow
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSigned writes a certificate for 127.0.0.1 and its key to dir
+func selfSigned(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "garrow test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return
+}
+
+// h2Client speaks HTTP/2 to the proxy itself, destinations going in
+// :authority
+func h2Client(tlsConfig *tls.Config) *http.Client {
+	p := new(http.Protocols)
+	if tlsConfig != nil {
+		p.SetHTTP2(true)
+	} else {
+		p.SetUnencryptedHTTP2(true)
+	}
+	return &http.Client{Transport: &http.Transport{Protocols: p, TLSClientConfig: tlsConfig}}
+}
+
+func echoListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+// h2Connect opens a CONNECT stream to dest and checks it echoes
+func h2Connect(t *testing.T, client *http.Client, proxy *url.URL, dest string) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Scheme: proxy.Scheme, Host: proxy.Host},
+		Host:   dest,
+		Header: make(http.Header),
+		Body:   pr,
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.ProtoMajor != 2 {
+		t.Fatalf("want HTTP/2 200, got %s %d", res.Proto, res.StatusCode)
+	}
+	pw.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(res.Body, b); err != nil || string(b) != "ping" {
+		t.Fatal("no echo", string(b), err)
+	}
+}
+
+func h2Get(t *testing.T, client *http.Client, proxy *url.URL, dest string) {
+	req, _ := http.NewRequest("GET", proxy.String()+"/h2", nil)
+	req.Host = dest
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.ProtoMajor != 2 || string(body) != "hello /h2" {
+		t.Errorf("want 'hello /h2' over HTTP/2, got %s %q", res.Proto, body)
+	}
+}
+
+func TestH2CProxy(t *testing.T) {
+	var conns int32
+	origin := countingOrigin(&conns)
+	defer origin.Close()
+	echo := echoListener(t)
+	defer echo.Close()
+	_, proxy, stop := startArrow(t, &Config{LocalHTTP2: true})
+	defer stop()
+
+	client := h2Client(nil)
+	h2Get(t, client, proxy, origin.Listener.Addr().String())
+	// both streams on the conn of the GET
+	h2Connect(t, client, proxy, echo.Addr().String())
+	h2Connect(t, client, proxy, echo.Addr().String())
+}
+
+func TestTLSProxy(t *testing.T) {
+	var conns int32
+	origin := countingOrigin(&conns)
+	defer origin.Close()
+	echo := echoListener(t)
+	defer echo.Close()
+	certFile, keyFile := selfSigned(t, t.TempDir())
+	_, proxy, stop := startArrow(t, &Config{LocalTLSCert: certFile, LocalTLSKey: keyFile})
+	defer stop()
+	proxy.Scheme = "https"
+
+	client := h2Client(&tls.Config{InsecureSkipVerify: true})
+	h2Get(t, client, proxy, origin.Listener.Addr().String())
+	h2Connect(t, client, proxy, echo.Addr().String())
+
+	// HTTP/1.1 clients are still served over TLS
+	http1 := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxy),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	res, err := http1.Get(origin.URL + "/h1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "hello /h1" {
+		t.Errorf("want 'hello /h1', got %q", body)
+	}
+}
+
+func TestExtendedConnect(t *testing.T) {
+	origin := echoUpgrade(t)
+	defer origin.Close()
+	cc, _, stop := startArrow(t, &Config{})
+	defer stop()
+	c := NewClient(cc).(*Client)
+	h := &ProxyHandler{config: c.Config, logger: c.logger, stats: c.stats}
+
+	// as the HTTP/2 server hands it over, net/http can't send :protocol
+	r := httptest.NewRequest("CONNECT", "/ws", strings.NewReader("ping\n"))
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+	r.Host = origin.Listener.Addr().String()
+	r.Header.Set(":protocol", "echo")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "ping\n" {
+		t.Errorf("want 200 and ping echoed, got %d %q", w.Code, w.Body)
+	}
+	if w.Header().Get("Upgrade") != "" {
+		t.Errorf("hop-by-hop headers of the 101 passed on: %v", w.Header())
+	}
+}
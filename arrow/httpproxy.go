@@ -0,0 +1,258 @@
+package arrow
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	raven "github.com/getsentry/raven-go"
+)
+
+// viaName is the pseudonym the client adds to Via headers
+const viaName = "garrow"
+
+// forwardHTTP relays a plain HTTP request as an RFC 7230 proxy: hop-by-hop
+// headers are stripped both ways, Via is added, the response body is
+// flushed as it arrives and its trailers are passed on
+func (h *ProxyHandler) forwardHTTP(w http.ResponseWriter, r *http.Request, config *Config, direct bool) {
+	defer r.Body.Close()
+	var d = &dialInfo{
+		config: config,
+		rHost:  destination(r),
+		direct: direct,
+		tls:    r.URL.Scheme == "https",
+		dial:   h.dial,
+	}
+	out := r.WithContext(context.WithValue(r.Context(), "d", d))
+	if r.ContentLength == 0 {
+		// the transport would otherwise wait on an empty body
+		out.Body = nil
+	}
+	out.Close = false
+	if out.URL.Host == "" {
+		// HTTP/2 requests only carry their destination in :authority
+		u := *out.URL
+		u.Scheme, u.Host = "http", r.Host
+		out.URL = &u
+	}
+	addVia(out.Header, r.ProtoMajor, r.ProtoMinor)
+	ex := h.capture.begin(out, d.rHost)
+	out.Body = ex.requestBody(out.Body)
+
+	res, err := h.transport(config.Timeouts).RoundTrip(out)
+	if err != nil {
+		ex.finish(err)
+		raven.CaptureErrorAndWait(err, nil)
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintln(w, "Error proxy request:", err)
+		return
+	}
+	defer res.Body.Close()
+	body := ex.response(res)
+
+	removeHopHeaders(res.Header)
+	addVia(res.Header, res.ProtoMajor, res.ProtoMinor)
+	writeHeader(w, res.Header)
+	if len(res.Trailer) > 0 {
+		names := make([]string, 0, len(res.Trailer))
+		for k := range res.Trailer {
+			names = append(names, k)
+		}
+		w.Header().Set("Trailer", strings.Join(names, ", "))
+	}
+	w.WriteHeader(res.StatusCode)
+
+	_, err = copyFlush(w, body)
+	ex.finish(err)
+	if err != nil {
+		h.logger.Debugln("Error copying response of", r.URL, ":", err)
+		// a clean end would pass the truncated body for a complete one
+		panic(http.ErrAbortHandler)
+	}
+	// filled once the body is read, declared above
+	for k, vv := range res.Trailer {
+		w.Header()[k] = vv
+	}
+}
+
+// copyFlush copies src to w, flushing every read so streamed responses
+// reach the browser as they come
+func copyFlush(w http.ResponseWriter, src io.Reader) (written int64, err error) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			nw, werr := w.Write(buf[:n])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// removeHopHeaders deletes the hop-by-hop headers of RFC 7230 section 6.1,
+// including those listed by Connection
+func removeHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// headerHasToken reports whether the comma separated values of name in
+// header contain token
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, v := range header[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// destination is the host:port r goes to, the CONNECT destination for the
+// https requests of intercepted tunnels
+func destination(r *http.Request) string {
+	if r.URL.Scheme != "https" {
+		return r.Host
+	}
+	if _, _, err := net.SplitHostPort(r.URL.Host); err != nil {
+		return net.JoinHostPort(strings.Trim(r.URL.Host, "[]"), "443")
+	}
+	return r.URL.Host
+}
+
+// addVia appends the protocol version received, just "2" for HTTP/2
+func addVia(header http.Header, major, minor int) {
+	version := fmt.Sprintf("%d.%d", major, minor)
+	if major >= 2 {
+		version = strconv.Itoa(major)
+	}
+	header.Add("Via", version+" "+viaName)
+}
+
+// upgradeType is the protocol header asks to switch to, empty for none
+func upgradeType(header http.Header) string {
+	if !headerHasToken(header, "Connection", "upgrade") {
+		return ""
+	}
+	return header.Get("Upgrade")
+}
+
+// serveUpgrade sends a request asking to switch protocols, e.g. a plain
+// WebSocket handshake, over a raw tunnel and pipes both ways after 101
+func (h *ProxyHandler) serveUpgrade(w http.ResponseWriter, r *http.Request, config *Config, direct bool, upgrade string) {
+	hj, ok := w.(http.Hijacker)
+	if !ok && r.ProtoMajor != 2 {
+		http.Error(w, "Error doing proxy hijack", http.StatusInternalServerError)
+		return
+	}
+	dest := destination(r)
+	rConn, err := h.dialHost(config, dest, direct)
+	if err != nil {
+		http.Error(w, fmt.Sprint("Error connecting proxy server: ", err), http.StatusBadGateway)
+		return
+	}
+	defer rConn.Close()
+	if r.URL.Scheme == "https" {
+		tc := tls.Client(rConn, &tls.Config{ServerName: stripPort(dest), RootCAs: h.mitm.originRoots()})
+		if err = tc.Handshake(); err != nil {
+			http.Error(w, fmt.Sprint("Error proxy request: ", err), http.StatusBadGateway)
+			return
+		}
+		rConn = tc
+	}
+
+	// stripped with the other hop-by-hop headers
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", upgrade)
+	addVia(r.Header, r.ProtoMajor, r.ProtoMinor)
+	if _, ok := r.Header["User-Agent"]; !ok {
+		// stop Request.Write adding the Go default one
+		r.Header["User-Agent"] = []string{""}
+	}
+	handshake := r
+	if r.ProtoMajor == 2 {
+		// the body of an extended CONNECT is the upgraded conn
+		handshake = new(http.Request)
+		*handshake = *r
+		handshake.Body = nil
+		handshake.ContentLength = 0
+	}
+	if err = handshake.Write(rConn); err != nil {
+		http.Error(w, fmt.Sprint("Error proxy request: ", err), http.StatusBadGateway)
+		return
+	}
+	br := bufio.NewReader(rConn)
+	res, err := http.ReadResponse(br, r)
+	for err == nil && res.StatusCode < 200 && res.StatusCode != http.StatusSwitchingProtocols {
+		res, err = http.ReadResponse(br, r)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprint("Error proxy request: ", err), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		// refused, answered like any other response
+		removeHopHeaders(res.Header)
+		addVia(res.Header, res.ProtoMajor, res.ProtoMinor)
+		writeHeader(w, res.Header)
+		w.WriteHeader(res.StatusCode)
+		copyFlush(w, res.Body)
+		return
+	}
+	if got := upgradeType(res.Header); !strings.EqualFold(got, upgrade) {
+		http.Error(w, fmt.Sprintf("Origin switched to %q instead of %q", got, upgrade), http.StatusBadGateway)
+		return
+	}
+
+	if r.ProtoMajor == 2 {
+		// RFC 8441, the stream itself carries the upgraded conn
+		removeHopHeaders(res.Header)
+		res.Header.Del("Sec-WebSocket-Accept")
+		writeHeader(w, res.Header)
+		w.WriteHeader(http.StatusOK)
+		up, down, err := relay(newStreamConn(w, r), &bufferedConn{rConn, br})
+		h.logger.Debugln("UPGRADE", upgrade, r.Host, "stream done, up:", up, "down:", down, "err:", err)
+		return
+	}
+	cConn, buf, err := hj.Hijack()
+	if err != nil {
+		h.logger.Errorln("Error doing proxy hijack:", err)
+		return
+	}
+	defer cConn.Close()
+	addVia(res.Header, res.ProtoMajor, res.ProtoMinor)
+	if err = res.Write(cConn); err != nil {
+		return
+	}
+	up, down, err := relay(&bufferedConn{cConn, buf.Reader}, &bufferedConn{rConn, br})
+	h.logger.Debugln("UPGRADE", upgrade, r.Host, "done, up:", up, "down:", down, "err:", err)
+}
@@ -0,0 +1,226 @@
+package arrow
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func proxyClient(proxy *url.URL) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyURL(proxy),
+		ExpectContinueTimeout: 5 * time.Second,
+	}}
+}
+
+func TestForwardHeaders(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Secret") != "" || r.Header.Get("Keep-Alive") != "" {
+			t.Errorf("hop-by-hop request headers forwarded: %v", r.Header)
+		}
+		if r.Header.Get("Te") != "trailers" {
+			t.Errorf("want TE: trailers kept, got %q", r.Header.Get("Te"))
+		}
+		if via := r.Header.Get("Via"); via != "1.1 garrow" {
+			t.Errorf("want request Via '1.1 garrow', got %q", via)
+		}
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("body"))
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer origin.Close()
+	_, proxy, stop := startArrow(t, &Config{})
+	defer stop()
+
+	req, _ := http.NewRequest("GET", origin.URL+"/", nil)
+	req.Header.Set("Connection", "X-Secret")
+	req.Header.Set("X-Secret", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Te", "trailers")
+	res, err := proxyClient(proxy).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "body" {
+		t.Errorf("want body, got %q", body)
+	}
+	if res.Header.Get("X-Hop") != "" {
+		t.Errorf("hop-by-hop response header forwarded: %v", res.Header)
+	}
+	if via := res.Header.Get("Via"); via != "1.1 garrow" {
+		t.Errorf("want response Via '1.1 garrow', got %q", via)
+	}
+	if got := res.Trailer.Get("X-Checksum"); got != "abc" {
+		t.Errorf("want trailer abc, got %q", got)
+	}
+}
+
+func TestForwardFlushes(t *testing.T) {
+	next := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 2; i++ {
+			w.Write([]byte("data: tick\n\n"))
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+	defer origin.Close()
+	defer close(next)
+	_, proxy, stop := startArrow(t, &Config{})
+	defer stop()
+
+	res, err := proxyClient(proxy).Get(origin.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	br := bufio.NewReader(res.Body)
+	for i := 0; i < 2; i++ {
+		done := make(chan string, 1)
+		go func() {
+			line, _ := br.ReadString('\n')
+			br.ReadString('\n')
+			done <- line
+		}()
+		select {
+		case line := <-done:
+			if line != "data: tick\n" {
+				t.Fatalf("want an event, got %q", line)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("event not flushed")
+		}
+		next <- struct{}{}
+	}
+}
+
+func TestForwardExpectContinue(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/refuse" {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer origin.Close()
+	_, proxy, stop := startArrow(t, &Config{})
+	defer stop()
+	client := proxyClient(proxy)
+
+	post := func(path string) (*http.Response, bool) {
+		read := false
+		payload := strings.NewReader("payload")
+		body := readerFunc(func(p []byte) (int, error) {
+			read = true
+			return payload.Read(p)
+		})
+		req, _ := http.NewRequest("POST", origin.URL+path, ioutil.NopCloser(body))
+		req.ContentLength = int64(len("payload"))
+		req.Header.Set("Expect", "100-continue")
+		start := time.Now()
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if time.Since(start) > 4*time.Second {
+			t.Errorf("%s waited for the continue timeout", path)
+		}
+		return res, read
+	}
+
+	res, _ := post("/echo")
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "payload" {
+		t.Errorf("want payload echoed, got %q", body)
+	}
+
+	res, read := post("/refuse")
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("want 413, got %d", res.StatusCode)
+	}
+	if read {
+		t.Error("body sent although the origin refused it")
+	}
+}
+
+// echoUpgrade switches to an echo protocol, refusing requests to /refuse
+func echoUpgrade(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/refuse" || upgradeType(r.Header) != "echo" {
+			http.Error(w, "no upgrade", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasSuffix(r.Header.Get("Via"), " garrow") {
+			t.Errorf("want Via on the handshake, got %v", r.Header)
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		line, _ := buf.ReadString('\n')
+		conn.Write([]byte(line))
+	}))
+}
+
+func TestUpgrade(t *testing.T) {
+	origin := echoUpgrade(t)
+	defer origin.Close()
+	_, proxy, stop := startArrow(t, &Config{})
+	defer stop()
+
+	handshake := func(path string) (*http.Response, *bufio.Reader, net.Conn) {
+		conn, err := net.Dial("tcp", proxy.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the first message rides along with the handshake
+		fmt.Fprintf(conn, "GET %s%s HTTP/1.1\r\nHost: %s\r\nConnection: keep-alive, Upgrade\r\n"+
+			"Upgrade: echo\r\n\r\nping\n", origin.URL, path, origin.Listener.Addr())
+		br := bufio.NewReader(conn)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, br, conn
+	}
+
+	res, br, conn := handshake("/ws")
+	defer conn.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("want 101 to echo, got %d %v", res.StatusCode, res.Header)
+	}
+	if line, _ := br.ReadString('\n'); line != "ping\n" {
+		t.Errorf("want ping echoed, got %q", line)
+	}
+
+	res, _, conn = handshake("/refuse")
+	defer conn.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("want the refusal passed on, got %d", res.StatusCode)
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,275 @@
+package arrow
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// mitmMaxCerts bounds the leaf certificates kept, the cache is dropped
+	// once full
+	mitmMaxCerts = 1024
+	mitmCertTTL  = 365 * 24 * time.Hour
+	caTTL        = 10 * 365 * 24 * time.Hour
+)
+
+// GenerateCA returns a new CA certificate and its key, PEM encoded, for
+// the client to sign the certificates of intercepted hosts with
+func GenerateCA(name string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"GArrow"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caTTL),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// mitm terminates TLS for config.mitm-hosts with certificates signed by
+// config.mitm-ca-cert, so the client can log the requests inside
+type mitm struct {
+	hosts   []string
+	ca      *x509.Certificate
+	caKey   interface{}
+	leafKey *ecdsa.PrivateKey
+	roots   *x509.CertPool
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// newMITM loads the CA of c, nil when c intercepts nothing
+func newMITM(c *Config) (*mitm, error) {
+	if len(c.MITMHosts) == 0 {
+		return nil, nil
+	}
+	for _, h := range c.MITMHosts {
+		if h == "*" {
+			return nil, fmt.Errorf("config.mitm-hosts: list the hosts to intercept instead of *")
+		}
+	}
+	if c.MITMCACert == "" || c.MITMCAKey == "" {
+		return nil, fmt.Errorf("config.mitm-hosts needs mitm-ca-cert and mitm-ca-key, see garrow ca")
+	}
+	pair, err := tls.LoadX509KeyPair(c.MITMCACert, c.MITMCAKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !ca.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", c.MITMCACert)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &mitm{
+		hosts:   c.MITMHosts,
+		ca:      ca,
+		caKey:   pair.PrivateKey,
+		leafKey: leafKey,
+		roots:   c.MITMOriginRoots,
+		certs:   make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// originRoots verify intercepted origins, nil for the system roots, m may
+// be nil
+func (m *mitm) originRoots() *x509.CertPool {
+	if m == nil {
+		return nil
+	}
+	return m.roots
+}
+
+// intercepts reports whether CONNECTs to host are terminated, m may be nil
+func (m *mitm) intercepts(host string) bool {
+	if m == nil {
+		return false
+	}
+	host = stripPort(host)
+	for _, p := range m.hosts {
+		if matchHost(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// certFor returns a certificate for host, signed on first use
+func (m *mitm) certFor(host string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cert, ok := m.certs[host]; ok {
+		return cert, nil
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	notAfter := time.Now().Add(mitmCertTTL)
+	if notAfter.After(m.ca.NotAfter) {
+		notAfter = m.ca.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, m.ca, &m.leafKey.PublicKey, m.caKey)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, m.ca.Raw},
+		PrivateKey:  m.leafKey,
+	}
+	if len(m.certs) >= mitmMaxCerts {
+		m.certs = make(map[string]*tls.Certificate)
+	}
+	m.certs[host] = cert
+	return cert, nil
+}
+
+// tlsConfig presents certificates for the SNI of clients, or for the
+// CONNECT host when they send none
+func (m *mitm) tlsConfig(host string) *tls.Config {
+	return &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = stripPort(host)
+			}
+			return m.certFor(name)
+		},
+	}
+}
+
+// intercept serves the HTTPS requests of a CONNECT to host, decrypted with
+// a certificate of the CA, logging them and sending them on over TLS
+func (h *ProxyHandler) intercept(conn net.Conn, host string, config *Config, direct bool) {
+	tlsConn := tls.Server(conn, h.mitm.tlsConfig(host))
+	tlsConn.SetDeadline(time.Now().Add(config.Handshake))
+	if err := tlsConn.Handshake(); err != nil {
+		h.logger.Infoln("MITM handshake for", host, "failed, is the garrow CA trusted?", err)
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	done := make(chan struct{})
+	l := &connListener{conn: &closeNotifyConn{Conn: tlsConn, done: done}, done: done}
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme, r.URL.Host = "https", host
+			h.logger.Infoln("MITM", r.Method, r.URL, r.Proto)
+			h.logger.Debugln("MITM request header:", r.Header)
+			upgrade := upgradeType(r.Header)
+			h.preprocessHeader(r)
+			if upgrade != "" {
+				h.serveUpgrade(w, r, config, direct, upgrade)
+			} else {
+				h.forwardHTTP(w, r, config, direct)
+			}
+		}),
+		IdleTimeout: config.Idle,
+	}
+	s.Serve(l)
+}
+
+// connListener hands a single conn to http.Server, then waits for it to be
+// closed, by the server or whoever hijacked it
+type connListener struct {
+	conn net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (l *connListener) Accept() (c net.Conn, err error) {
+	l.once.Do(func() {
+		c = l.conn
+	})
+	if c != nil {
+		return
+	}
+	<-l.done
+	return nil, errListenerDone
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+var errListenerDone = errors.New("Conn done")
+
+// closeNotifyConn closes done once closed
+type closeNotifyConn struct {
+	net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *closeNotifyConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
+
+// CloseWrite keeps half-close working through the wrapper
+func (c *closeNotifyConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
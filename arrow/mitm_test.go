@@ -0,0 +1,79 @@
+package arrow
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestMITMIntercepts(t *testing.T) {
+	m := &mitm{hosts: []string{"api.example.com", "*.test"}}
+	for host, want := range map[string]bool{
+		"api.example.com:443":    true,
+		"v2.api.example.com:443": true,
+		"example.com:443":        false,
+		"a.test:443":             true,
+	} {
+		if m.intercepts(host) != want {
+			t.Errorf("%s: want %v", host, want)
+		}
+	}
+	var none *mitm
+	if none.intercepts("api.example.com:443") {
+		t.Error("nil mitm intercepts")
+	}
+	if _, err := newMITM(&Config{MITMHosts: []string{"*"}}); err == nil {
+		t.Error("* should be refused")
+	}
+}
+
+func TestMITM(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer origin.Close()
+	originRoots := x509.NewCertPool()
+	originRoots.AddCert(origin.Certificate())
+
+	dir := t.TempDir()
+	certPEM, keyPEM, err := GenerateCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	ioutil.WriteFile(certFile, certPEM, 0644)
+	ioutil.WriteFile(keyFile, keyPEM, 0600)
+	_, proxy, stop := startArrow(t, &Config{
+		MITMHosts:  []string{"127.0.0.1"},
+		MITMCACert: certFile,
+		MITMCAKey:  keyFile,
+		// trusts the test origin
+		MITMOriginRoots: originRoots,
+	})
+	defer stop()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxy),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	for _, p := range []string{"/a", "/b"} {
+		res, err := client.Get(origin.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "hello "+p {
+			t.Errorf("want 'hello %s', got %q", p, body)
+		}
+		if cn := res.TLS.PeerCertificates[0].Issuer.CommonName; cn != "test CA" {
+			t.Errorf("want a certificate of the test CA, got one of %s", cn)
+		}
+	}
+}
@@ -9,59 +9,139 @@ import (
 	"time"
 )
 
-func Dial(network, remote, password string) (c net.Conn, err error) {
+// Dial connects to the configured server
+func Dial(network string, config *Config) (c net.Conn, err error) {
 	var rc net.Conn
 
-	rc, err = net.Dial(network, remote)
+	rc, err = NewDialer(config).Dial(network, config.ServerAddress, config.Dial)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error connecting proxy server", err)
 		return
 	}
-	cipher, err := NewCipher(password)
-	if err != nil {
+	if c, err = newTunnelConn(rc, config, config.Idle, nil); err != nil {
+		rc.Close()
 		fmt.Fprintln(os.Stderr, "Error getting cipher", err)
-		return
 	}
-	ec := NewArrowConn(rc, cipher, IDLE_TIMEOUT)
-	return ec, nil
+	return
 }
 
-var ArrowTransport = &http.Transport{
-	DialContext: func(ctx context.Context, network, _ string) (c net.Conn, err error) {
-		d := ctx.Value("d").(*map[string]string)
-		c, err = Dial(network, (*d)["address"], (*d)["password"])
-		setHost(c, (*d)["rHost"])
-		return
-	},
-	DisableKeepAlives:     false,
-	DisableCompression:    false,
-	MaxIdleConns:          10,
-	MaxIdleConnsPerHost:   10,
-	IdleConnTimeout:       5 * time.Second,
-	ResponseHeaderTimeout: 5 * time.Second,
+// newTunnelConn wraps rc in the protocol and cipher of config, replay being
+// the server's filter of seen IVs and nil on the client
+func newTunnelConn(rc net.Conn, config *Config, timeout time.Duration, replay *replayFilter) (net.Conn, error) {
+	method := config.Method
+	if method == "" {
+		method = DefaultMethod
+	}
+	ss := config.Protocol == ProtocolShadowsocks
+	if m := cipherMethods[method]; ss && m.aead {
+		return newAEADConn(rc, evpBytesToKey(config.Password, m.keySize), timeout, replay), nil
+	}
+	cipher, err := newCipher(method, config.Password, config.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	c := NewArrowConn(rc, cipher, timeout)
+	c.shadowsocks = ss
+	c.replay = replay
+	return c, nil
+}
+
+// dialHost connects to rHost, through the server unless direct
+func dialHost(config *Config, rHost string, direct bool) (net.Conn, error) {
+	if direct {
+		return NewDialer(config).Dial("tcp", ensurePort(rHost), config.Dial)
+	}
+	rConn, err := Dial("tcp", config)
+	if err != nil {
+		return nil, err
+	}
+	if err = setHost(rConn, rHost); err != nil {
+		rConn.Close()
+		return nil, fmt.Errorf("Error negotiating with proxy server: %s", err)
+	}
+	return rConn, nil
+}
+
+// expectContinueTimeout is how long a body waits for 100 Continue before
+// being sent anyway
+const expectContinueTimeout = time.Second
+
+// dialInfo is carried in request context for ArrowTransport
+type dialInfo struct {
+	config *Config
+	rHost  string
+	direct bool
+	// tls is set for https requests, whose tunnel carries raw bytes
+	tls bool
+	// dial is the ProxyHandler's own, when set
+	dial func(rHost string) (net.Conn, error)
+}
+
+// ArrowTransport relays plain HTTP requests with the default timeouts
+var ArrowTransport = NewArrowTransport(defaultTimeouts)
+
+// NewArrowTransport returns a transport dialing through the server found in
+// the request context, t bounds the HTTP exchange itself
+func NewArrowTransport(t Timeouts) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (c net.Conn, err error) {
+			d := ctx.Value("d").(*dialInfo)
+			if d.dial != nil {
+				return d.dial(d.rHost)
+			}
+			if d.direct {
+				return NewDialer(d.config).DialContext(ctx, network, ensurePort(d.rHost))
+			}
+			if d.tls {
+				return dialHost(d.config, d.rHost, false)
+			}
+			c, err = Dial(network, d.config)
+			if err != nil {
+				return
+			}
+			setHTTPHost(c, d.rHost)
+			return
+		},
+		DisableKeepAlives:     false,
+		DisableCompression:    false,
+		MaxIdleConns:          10,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       t.IdleConn,
+		ResponseHeaderTimeout: t.ResponseHeader,
+		// hold bodies sent with Expect: 100-continue until the origin asks
+		ExpectContinueTimeout: expectContinueTimeout,
+	}
 }
 
 type ArrowListener struct {
 	net.Listener
-	password string
+	config *Config
+	replay *replayFilter
 }
 
 func (l *ArrowListener) Accept() (c net.Conn, err error) {
-	cipher, err := NewCipher(l.password)
+	rc, err := l.Listener.Accept()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error getting cipher", err)
 		return
 	}
-	rc, err := l.Listener.Accept()
-	ec := NewArrowConn(rc, cipher, IDLE_TIMEOUT)
-	return ec, nil
+	l.config.setKeepAlive(rc)
+	// the server extends it to the idle timeout once the header is read
+	if c, err = newTunnelConn(rc, l.config, l.config.Handshake, l.replay); err != nil {
+		rc.Close()
+		fmt.Fprintln(os.Stderr, "Error getting cipher", err)
+	}
+	return
 }
 
-func ArrowListen(network, address, password string) (l net.Listener, err error) {
-	rl, err := net.Listen(network, address)
+func ArrowListen(network string, config *Config) (l net.Listener, err error) {
+	rl, err := net.Listen(network, config.ServerAddress)
+	if err != nil {
+		return
+	}
 	l = &ArrowListener{
 		Listener: rl,
-		password: password,
+		config:   config,
+		replay:   newReplayFilter(),
 	}
 	return
 }
@@ -0,0 +1,162 @@
+package arrow
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// Paths the client answers itself instead of proxying
+const (
+	pacPath    = "/proxy.pac"
+	statusPath = "/garrow-status"
+)
+
+// ruleStats counts the destinations routed by each rule of a client
+type ruleStats struct {
+	started time.Time
+	// hits of every rule, then of destinations no rule matched
+	hits []int64
+}
+
+func newRuleStats(c *Config) *ruleStats {
+	return &ruleStats{
+		started: time.Now(),
+		hits:    make([]int64, len(c.Rules)+1),
+	}
+}
+
+// route returns the config for host and whether to dial it without the
+// server, counting the rule hit
+func (s *ruleStats) route(c *Config, host string) (*Config, bool) {
+	i := c.ruleFor(host)
+	if s != nil {
+		if i < 0 {
+			atomic.AddInt64(&s.hits[len(s.hits)-1], 1)
+		} else {
+			atomic.AddInt64(&s.hits[i], 1)
+		}
+	}
+	return c.forRule(i), i >= 0 && c.Rules[i].Direct()
+}
+
+// isLocal reports whether r is addressed to the proxy itself rather than
+// to be proxied
+func isLocal(r *http.Request) bool {
+	if r.Method == "CONNECT" {
+		return false
+	}
+	host := r.URL.Host
+	if r.ProtoMajor == 2 {
+		// proxied requests too only carry their destination in :authority
+		host = r.Host
+	} else if host == "" {
+		return true
+	}
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && ensurePort(host) == local.String()
+}
+
+// serveLocal answers the pac file, status page and capture switch
+func (h *ProxyHandler) serveLocal(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case pacPath:
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		writePAC(w, h.config, r.Host)
+	case statusPath:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		h.writeStatus(w)
+	case capturePath:
+		h.capture.serve(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writePAC generates a pac file following the rules of c, proxy being the
+// client address as seen by the browser
+func writePAC(w io.Writer, c *Config, proxy string) {
+	host, _, err := net.SplitHostPort(proxy)
+	if err != nil {
+		host = stripPort(proxy)
+	}
+	through := "PROXY " + ensurePort(proxy)
+	if c.LocalTLSCert != "" {
+		through = "HTTPS " + ensurePort(proxy)
+	}
+	if c.SocksAddress != "" {
+		if _, port, err := net.SplitHostPort(c.SocksAddress); err == nil {
+			through += "; SOCKS5 " + net.JoinHostPort(host, port)
+		}
+	}
+
+	fmt.Fprintln(w, "function FindProxyForURL(url, host) {")
+	fmt.Fprintln(w, "  host = host.toLowerCase();")
+	for _, r := range c.Rules {
+		var conds []string
+		for _, p := range r.Hosts {
+			if cond := pacCondition(p); cond != "" {
+				conds = append(conds, cond)
+			}
+		}
+		if len(conds) == 0 {
+			continue
+		}
+		action := through
+		if r.Direct() {
+			action = "DIRECT"
+		}
+		fmt.Fprintf(w, "  if (%s) return %q;\n", strings.Join(conds, " || "), action)
+	}
+	fmt.Fprintf(w, "  return %q;\n", through)
+	fmt.Fprintln(w, "}")
+}
+
+// pacCondition is the javascript test of one host pattern, matching host
+// literally as the client does
+func pacCondition(pattern string) string {
+	pattern = strings.ToLower(pattern)
+	switch {
+	case pattern == "*":
+		return "true"
+	case strings.Contains(pattern, "/"):
+		ip, n, err := net.ParseCIDR(pattern)
+		if err != nil || ip.To4() == nil {
+			// isInNet only knows IPv4
+			return ""
+		}
+		return fmt.Sprintf("(/^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host) && isInNet(host, %q, %q))",
+			n.IP.String(), net.IP(n.Mask).String())
+	case net.ParseIP(pattern) != nil:
+		return fmt.Sprintf("host == %q", pattern)
+	case strings.HasPrefix(pattern, "*."):
+		return fmt.Sprintf("dnsDomainIs(host, %q)", pattern[1:])
+	}
+	return fmt.Sprintf("(host == %q || dnsDomainIs(host, %q))", pattern, "."+pattern)
+}
+
+func (h *ProxyHandler) writeStatus(w io.Writer) {
+	c := h.config
+	fmt.Fprintf(w, "server:  %s %s (%s)\n", c.Name, c.ServerAddress, c.Method)
+	if h.stats == nil {
+		return
+	}
+	fmt.Fprintf(w, "uptime:  %s\n\n", time.Since(h.stats.started).Truncate(time.Second))
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "hits\taction\thosts")
+	for i, r := range c.Rules {
+		action := r.Action
+		if action == "" {
+			action = ActionProxy
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", atomic.LoadInt64(&h.stats.hits[i]), action, strings.Join(r.Hosts, ", "))
+	}
+	fmt.Fprintf(tw, "%d\t%s\t%s\n", atomic.LoadInt64(&h.stats.hits[len(c.Rules)]), ActionProxy, "(no rule)")
+	tw.Flush()
+}
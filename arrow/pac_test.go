@@ -0,0 +1,86 @@
+package arrow
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWritePAC(t *testing.T) {
+	c := &Config{
+		SocksAddress: ":1080",
+		Rules: []Rule{
+			{Hosts: []string{"*.lan", "10.0.0.0/8", "fd00::/8"}, Action: ActionDirect},
+			{Hosts: []string{"example.com"}},
+		},
+	}
+	var b bytes.Buffer
+	writePAC(&b, c, "192.168.1.2:8888")
+	pac := b.String()
+	for _, want := range []string{
+		`if (dnsDomainIs(host, ".lan") || (/^\d+\.\d+\.\d+\.\d+$/.test(host) && isInNet(host, "10.0.0.0", "255.0.0.0"))) return "DIRECT";`,
+		`if ((host == "example.com" || dnsDomainIs(host, ".example.com"))) return "PROXY 192.168.1.2:8888; SOCKS5 192.168.1.2:1080";`,
+		`return "PROXY 192.168.1.2:8888; SOCKS5 192.168.1.2:1080";` + "\n}",
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("pac misses %s:\n%s", want, pac)
+		}
+	}
+}
+
+func TestClientLocalPages(t *testing.T) {
+	var conns int32
+	origin := countingOrigin(&conns)
+	defer origin.Close()
+	// no server behind the client, only direct requests can succeed
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+	c := &Config{
+		ServerAddress: dead.Addr().String(),
+		LogLevel:      "error",
+		Rules:         []Rule{{Hosts: []string{"127.0.0.1"}, Action: ActionDirect}},
+	}
+	if err := c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go NewClient(c).(*Client).Serve(l)
+	proxy, _ := url.Parse("http://" + l.Addr().String())
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+	res, err := client.Get(origin.URL + "/direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "hello /direct" {
+		t.Errorf("got %q", body)
+	}
+
+	for path, want := range map[string]string{
+		pacPath:    `return "DIRECT"`,
+		statusPath: "1     direct  127.0.0.1",
+	} {
+		// asked directly, then through the proxy itself
+		for _, c := range []*http.Client{http.DefaultClient, client} {
+			res, err := c.Get(proxy.String() + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK || !strings.Contains(string(body), want) {
+				t.Errorf("%s: got %d %s", path, res.StatusCode, body)
+			}
+		}
+	}
+}
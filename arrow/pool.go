@@ -0,0 +1,208 @@
+package arrow
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPoolMaxIdlePerHost caps idle upstream conns kept per host
+	DefaultPoolMaxIdlePerHost = 4
+	// DefaultPoolMaxIdle caps idle upstream conns kept in total
+	DefaultPoolMaxIdle = 64
+)
+
+// PoolConn is an upstream conn handed out by ConnPool, Reader buffers
+// responses read from it and must be kept with it
+type PoolConn struct {
+	net.Conn
+	Reader  *bufio.Reader
+	host    string
+	timer   *time.Timer
+	reused  bool
+	timeout time.Duration
+}
+
+// Reused reports whether c was taken from the idle list
+func (c *PoolConn) Reused() bool {
+	return c.reused
+}
+
+func (c *PoolConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.refresh()
+	return
+}
+
+func (c *PoolConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.refresh()
+	return
+}
+
+// SetTimeout sets a deadline refreshed by every read and write, 0 clears
+// it before c goes back to the pool
+func (c *PoolConn) SetTimeout(t time.Duration) {
+	c.timeout = t
+	if t > 0 {
+		c.SetDeadline(time.Now().Add(t))
+	} else {
+		c.SetDeadline(time.Time{})
+	}
+}
+
+func (c *PoolConn) refresh() {
+	if c.timeout > 0 {
+		c.SetDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+// CloseWrite keeps half-close working for raw tunnels
+func (c *PoolConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// ConnPool keeps idle upstream conns of finished plain HTTP exchanges for
+// reuse. Only conns given back with Put are ever reused.
+type ConnPool struct {
+	MaxIdlePerHost int
+	MaxIdle        int
+	IdleTimeout    time.Duration
+	Dial           func(network, address string, timeout time.Duration) (net.Conn, error)
+
+	mu    sync.Mutex
+	idle  map[string][]*PoolConn
+	nIdle int
+}
+
+// NewConnPool returns a pool dialing with net.DialTimeout
+func NewConnPool(maxIdlePerHost, maxIdle int, idleTimeout time.Duration) *ConnPool {
+	return &ConnPool{
+		MaxIdlePerHost: maxIdlePerHost,
+		MaxIdle:        maxIdle,
+		IdleTimeout:    idleTimeout,
+		Dial:           net.DialTimeout,
+		idle:           make(map[string][]*PoolConn),
+	}
+}
+
+// Get returns a healthy idle conn to host, or dials a new one
+func (p *ConnPool) Get(host string, timeout time.Duration) (c *PoolConn, err error) {
+	for {
+		c = p.takeIdle(host)
+		if c == nil {
+			break
+		}
+		if c.healthy() {
+			c.reused = true
+			return
+		}
+		c.Conn.Close()
+	}
+
+	rc, err := p.Dial("tcp", host, timeout)
+	if err != nil {
+		return
+	}
+	c = &PoolConn{
+		Conn: rc,
+		host: host,
+	}
+	c.Reader = bufio.NewReader(c)
+	return
+}
+
+// Put gives c back for reuse, it's closed instead when the pool is full
+func (p *ConnPool) Put(c *PoolConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[c.host]
+	if len(conns) >= p.MaxIdlePerHost || p.nIdle >= p.MaxIdle {
+		c.Conn.Close()
+		return
+	}
+	p.idle[c.host] = append(conns, c)
+	p.nIdle++
+	if p.IdleTimeout > 0 {
+		c.timer = time.AfterFunc(p.IdleTimeout, func() {
+			if p.removeIdle(c) {
+				c.Conn.Close()
+			}
+		})
+	}
+}
+
+// Close closes every idle conn
+func (p *ConnPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for host, conns := range p.idle {
+		for _, c := range conns {
+			if c.timer != nil {
+				c.timer.Stop()
+			}
+			c.Conn.Close()
+		}
+		delete(p.idle, host)
+	}
+	p.nIdle = 0
+}
+
+// takeIdle pops the most recently used idle conn of host
+func (p *ConnPool) takeIdle(host string) (c *PoolConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[host]
+	if len(conns) == 0 {
+		return nil
+	}
+	c = conns[len(conns)-1]
+	p.setIdle(host, conns[:len(conns)-1])
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	return
+}
+
+// removeIdle drops c from the idle list, false if it was taken already
+func (p *ConnPool) removeIdle(c *PoolConn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[c.host]
+	for i, ic := range conns {
+		if ic == c {
+			p.setIdle(c.host, append(conns[:i:i], conns[i+1:]...))
+			return true
+		}
+	}
+	return false
+}
+
+// setIdle must be called with p.mu held
+func (p *ConnPool) setIdle(host string, conns []*PoolConn) {
+	p.nIdle += len(conns) - len(p.idle[host])
+	if len(conns) == 0 {
+		delete(p.idle, host)
+	} else {
+		p.idle[host] = conns
+	}
+}
+
+// healthy checks an idle conn wasn't closed by the peer and has no
+// unsolicited data pending
+func (c *PoolConn) healthy() bool {
+	if c.Reader.Buffered() > 0 {
+		return false
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := c.Reader.Peek(1)
+	c.Conn.SetReadDeadline(time.Time{})
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
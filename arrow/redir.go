@@ -0,0 +1,81 @@
+package arrow
+
+import (
+	"errors"
+	"net"
+)
+
+// errNoTransparent is returned where the kernel offers no transparent proxying
+var errNoTransparent = errors.New("Transparent proxy is only supported on linux")
+
+// ServeRedirect tunnels conns sent to l by an iptables REDIRECT rule to
+// their original destination
+func (c *Client) ServeRedirect(l net.Listener) error {
+	return c.serveTunnels(l, originalDst, true)
+}
+
+// ServeTProxy tunnels conns sent to l, a ListenTProxy listener, by an
+// iptables TPROXY rule. Their local address is the original destination.
+func (c *Client) ServeTProxy(l net.Listener) error {
+	return c.serveTunnels(l, func(conn net.Conn) (string, error) {
+		return conn.LocalAddr().String(), nil
+	}, true)
+}
+
+// serveTunnels relays every conn accepted from l to the destination dest
+// gives, refined by sniffing its first bytes when sniff is set
+func (c *Client) serveTunnels(l net.Listener, dest func(net.Conn) (string, error), sniff bool) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			rHost, err := dest(conn)
+			if err != nil {
+				c.logger.Errorln("Error getting destination: ", err)
+				return
+			}
+			c.tunnelTo(conn, rHost, sniff)
+		}()
+	}
+}
+
+// tunnelTo relays conn to rHost like an established CONNECT
+func (c *Client) tunnelTo(conn net.Conn, rHost string, sniff bool) {
+	s := sniffed{route: rHost, dial: rHost}
+	if sniff {
+		conn, s = c.sniff(conn, rHost)
+	}
+	if s.name != "" {
+		c.logger.Infoln("TUNNEL", conn.LocalAddr(), "->", rHost, "is", s.name)
+	} else {
+		c.logger.Infoln("TUNNEL", conn.LocalAddr(), "->", rHost)
+	}
+	config, direct := c.stats.route(c.Config, s.route)
+	rConn, err := dialHost(config, s.dial, direct)
+	if err != nil {
+		c.logger.Errorln("Error connecting", s.dial, ":", err)
+		return
+	}
+	defer rConn.Close()
+	up, down, err := relay(conn, rConn)
+	c.logger.Debugln("TUNNEL", rHost, "done, up:", up, "down:", down, "err:", err)
+}
+
+// dialUDPTunnel opens a tunnel carrying udpTunnelHost framed datagrams
+func dialUDPTunnel(config *Config) (net.Conn, error) {
+	tunnel, err := Dial("tcp", config)
+	if err != nil {
+		return nil, err
+	}
+	if err = sendHost(tunnel, udpTunnelHost); err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
@@ -0,0 +1,218 @@
+//go:build linux
+// +build linux
+
+package arrow
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// netfilter and ipv6 socket options missing from syscall
+const (
+	soOriginalDst       = 80 // SO_ORIGINAL_DST, also IP6T_SO_ORIGINAL_DST
+	ipv6RecvOrigDstAddr = 74 // IPV6_RECVORIGDSTADDR, also IPV6_ORIGDSTADDR
+	ipv6Transparent     = 75 // IPV6_TRANSPARENT
+)
+
+// originalDst asks conntrack where a REDIRECTed conn was going
+func originalDst(conn net.Conn) (address string, err error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("Not a tcp conn: %s", conn.RemoteAddr())
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return
+	}
+	v4 := tc.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	cerr := rc.Control(func(fd uintptr) {
+		// getsockopt with the sockaddr sized results syscall does offer
+		if v4 {
+			var mreq *syscall.IPv6Mreq
+			if mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); err == nil {
+				address = sockaddrString(mreq.Multiaddr[:], false)
+			}
+			return
+		}
+		var info *syscall.IPv6MTUInfo
+		if info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); err == nil {
+			address = sockaddrString((*[syscall.SizeofSockaddrInet6]byte)(unsafe.Pointer(&info.Addr))[:], true)
+		}
+	})
+	if cerr != nil {
+		return "", cerr
+	}
+	return
+}
+
+// sockaddrString formats a raw sockaddr_in or sockaddr_in6
+func sockaddrString(b []byte, v6 bool) string {
+	port := strconv.Itoa(int(b[2])<<8 | int(b[3]))
+	if v6 {
+		return net.JoinHostPort(net.IP(b[8:24]).String(), port)
+	}
+	return net.JoinHostPort(net.IP(b[4:8]).String(), port)
+}
+
+// transparentControl marks sockets IP_TRANSPARENT, so they accept traffic for
+// and send from any address, and asks for original destinations of datagrams
+func transparentControl(recvOrigDst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) (err error) {
+		v6 := network[len(network)-1] == '6'
+		cerr := c.Control(func(fd uintptr) {
+			opts := [][2]int{{syscall.SOL_IP, syscall.IP_TRANSPARENT}, {syscall.SOL_SOCKET, syscall.SO_REUSEADDR}}
+			if v6 {
+				opts = append(opts, [2]int{syscall.SOL_IPV6, ipv6Transparent})
+			}
+			if recvOrigDst {
+				opts = append(opts, [2]int{syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR})
+				if v6 {
+					opts = append(opts, [2]int{syscall.SOL_IPV6, ipv6RecvOrigDstAddr})
+				}
+			}
+			for _, o := range opts {
+				if err = syscall.SetsockoptInt(int(fd), o[0], o[1], 1); err != nil {
+					err = fmt.Errorf("Error setting transparent socket option %d: %s", o[1], err)
+					return
+				}
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return
+	}
+}
+
+// ListenTProxy listens for conns sent by an iptables TPROXY rule, it needs
+// CAP_NET_ADMIN
+func ListenTProxy(network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: transparentControl(false)}
+	return lc.Listen(context.Background(), network, address)
+}
+
+// ListenTProxyUDP listens for datagrams sent by an iptables TPROXY rule
+func ListenTProxyUDP(address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl(true)}
+	pc, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// ServeTProxyUDP relays the datagrams received on pc through one udp tunnel
+// per source address, the tunnels closing once idle
+func (c *Client) ServeTProxyUDP(pc *net.UDPConn) error {
+	var mu sync.Mutex
+	sessions := make(map[string]net.Conn)
+	buf := make([]byte, socksMaxUDPSize)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, from, err := pc.ReadMsgUDP(buf, oob)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			return err
+		}
+		dst, err := origDstAddr(oob[:oobn])
+		if err != nil {
+			c.logger.Debugln("Error getting original destination: ", err)
+			continue
+		}
+
+		key := from.String()
+		mu.Lock()
+		tunnel, ok := sessions[key]
+		mu.Unlock()
+		if !ok {
+			c.logger.Infoln("TPROXY udp", key, dst)
+			if tunnel, err = dialUDPTunnel(c.Config); err != nil {
+				c.logger.Errorln("Error opening udp tunnel: ", err)
+				continue
+			}
+			mu.Lock()
+			sessions[key] = tunnel
+			mu.Unlock()
+			go func(tunnel net.Conn, client *net.UDPAddr) {
+				c.tproxyReplies(tunnel, client)
+				mu.Lock()
+				delete(sessions, client.String())
+				mu.Unlock()
+				tunnel.Close()
+			}(tunnel, from)
+		}
+
+		msg, err := appendSocksAddr(make([]byte, 0, 19+n), dst)
+		if err != nil {
+			continue
+		}
+		if err = writeFrame(tunnel, append(msg, buf[:n]...)); err != nil && err != errFrameTooLarge {
+			tunnel.Close()
+		}
+	}
+}
+
+// tproxyReplies sends the datagrams coming back through tunnel to client,
+// each from the address it came from as if there was no proxy
+func (c *Client) tproxyReplies(tunnel net.Conn, client *net.UDPAddr) {
+	lc := net.ListenConfig{Control: transparentControl(false)}
+	senders := make(map[string]net.PacketConn)
+	defer func() {
+		for _, s := range senders {
+			s.Close()
+		}
+	}()
+	for {
+		msg, err := readFrame(tunnel)
+		if err != nil {
+			return
+		}
+		src, n, err := parseSocksAddr(msg)
+		if err != nil {
+			return
+		}
+		s, ok := senders[src]
+		if !ok {
+			if len(senders) >= udpMaxPeers {
+				for k, s := range senders {
+					s.Close()
+					delete(senders, k)
+				}
+			}
+			if s, err = lc.ListenPacket(context.Background(), "udp", src); err != nil {
+				c.logger.Debugln("Error binding reply socket: ", err)
+				continue
+			}
+			senders[src] = s
+		}
+		s.WriteTo(msg[n:], client)
+	}
+}
+
+// origDstAddr finds the original destination in the control messages of a
+// datagram read from a ListenTProxyUDP conn
+func origDstAddr(oob []byte) (string, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_ORIGDSTADDR &&
+			len(m.Data) >= syscall.SizeofSockaddrInet4:
+			return sockaddrString(m.Data, false), nil
+		case m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == ipv6RecvOrigDstAddr &&
+			len(m.Data) >= syscall.SizeofSockaddrInet6:
+			return sockaddrString(m.Data, true), nil
+		}
+	}
+	return "", fmt.Errorf("No original destination")
+}
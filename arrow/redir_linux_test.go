@@ -0,0 +1,144 @@
+//go:build linux
+// +build linux
+
+package arrow
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestSockaddrString(t *testing.T) {
+	cases := []struct {
+		b    []byte
+		v6   bool
+		want string
+	}{
+		{[]byte{2, 0, 0x1f, 0x90, 10, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}, false, "10.0.0.1:8080"},
+		{[]byte{2, 0, 0, 80, 127, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}, false, "127.0.0.1:80"},
+		{[]byte{10, 0, 0x01, 0xbb, 0, 0, 0, 0,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0, 0, 0, 0}, true, "[2001:db8::1]:443"},
+		{[]byte{10, 0, 0, 53, 0, 0, 0, 0,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 168, 1, 1,
+			0, 0, 0, 0}, true, "192.168.1.1:53"},
+	}
+	for _, c := range cases {
+		if got := sockaddrString(c.b, c.v6); got != c.want {
+			t.Errorf("want %s, got %s", c.want, got)
+		}
+	}
+}
+
+// cmsg builds a socket control message as read by ReadMsgUDP
+func cmsg(level, typ int, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+func TestOrigDstAddr(t *testing.T) {
+	v4 := []byte{2, 0, 0, 53, 8, 8, 8, 8, 0, 0, 0, 0, 0, 0, 0, 0}
+	v6 := make([]byte, syscall.SizeofSockaddrInet6)
+	copy(v6, []byte{10, 0, 0, 53})
+	copy(v6[8:], net.ParseIP("2001:4860:4860::8888"))
+	other := cmsg(syscall.SOL_IP, syscall.IP_TTL, []byte{64, 0, 0, 0})
+
+	cases := []struct {
+		oob  []byte
+		want string
+	}{
+		{cmsg(syscall.SOL_IP, syscall.IP_ORIGDSTADDR, v4), "8.8.8.8:53"},
+		{append(other, cmsg(syscall.SOL_IPV6, ipv6RecvOrigDstAddr, v6)...), "[2001:4860:4860::8888]:53"},
+		// too short for a sockaddr_in
+		{cmsg(syscall.SOL_IP, syscall.IP_ORIGDSTADDR, v4[:8]), ""},
+		{other, ""},
+	}
+	for _, c := range cases {
+		got, err := origDstAddr(c.oob)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("want error, got %s", got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("want %s, got %s %v", c.want, got, err)
+		}
+	}
+}
+
+// hasNetAdmin reads CAP_NET_ADMIN from the effective capabilities
+func hasNetAdmin() bool {
+	b, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "CapEff:") {
+			caps, err := strconv.ParseUint(strings.TrimSpace(line[len("CapEff:"):]), 16, 64)
+			return err == nil && caps&(1<<12) != 0
+		}
+	}
+	return false
+}
+
+// TestOriginalDstRedirect adds a rule to the nat OUTPUT chain of the host,
+// it only runs with GARROW_TEST_IPTABLES=1, in a throwaway vm or netns
+func TestOriginalDstRedirect(t *testing.T) {
+	if os.Getenv("GARROW_TEST_IPTABLES") != "1" {
+		t.Skip("changes host firewall rules, set GARROW_TEST_IPTABLES=1 to run")
+	}
+	if !hasNetAdmin() {
+		t.Skip("needs CAP_NET_ADMIN")
+	}
+	if _, err := exec.LookPath("iptables"); err != nil {
+		t.Skip("needs iptables")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// a port nothing listens on, conns to it land on l
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := free.Addr().String()
+	free.Close()
+	_, dport, _ := net.SplitHostPort(dest)
+	_, toPort, _ := net.SplitHostPort(l.Addr().String())
+	rule := []string{"OUTPUT", "-t", "nat", "-p", "tcp", "-d", "127.0.0.1", "--dport", dport, "-j", "REDIRECT", "--to-ports", toPort}
+	if out, err := exec.Command("iptables", append([]string{"-A"}, rule...)...).CombinedOutput(); err != nil {
+		t.Skipf("adding REDIRECT rule: %s %s", err, out)
+	}
+	defer exec.Command("iptables", append([]string{"-D"}, rule...)...).Run()
+
+	conn, err := net.DialTimeout("tcp", dest, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, err := originalDst(rc)
+	if err != nil || got != dest {
+		t.Errorf("want %s, got %s %v", dest, got, err)
+	}
+}
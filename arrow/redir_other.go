@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package arrow
+
+import "net"
+
+func originalDst(conn net.Conn) (string, error) {
+	return "", errNoTransparent
+}
+
+// ListenTProxy is only supported on linux
+func ListenTProxy(network, address string) (net.Listener, error) {
+	return nil, errNoTransparent
+}
+
+// ListenTProxyUDP is only supported on linux
+func ListenTProxyUDP(address string) (*net.UDPConn, error) {
+	return nil, errNoTransparent
+}
+
+// ServeTProxyUDP is only supported on linux
+func (c *Client) ServeTProxyUDP(pc *net.UDPConn) error {
+	return errNoTransparent
+}
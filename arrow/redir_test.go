@@ -0,0 +1,48 @@
+package arrow
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeTransparent(t *testing.T) {
+	cc, _, stop := startArrow(t, &Config{})
+	defer stop()
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	go func() {
+		c, err := origin.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// stands in for conntrack, every conn was headed to origin
+	go NewClient(cc).(*Client).serveTunnels(l, func(net.Conn) (string, error) {
+		return origin.Addr().String(), nil
+	}, false)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatal("no echo", string(b), err)
+	}
+}
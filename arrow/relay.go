@@ -0,0 +1,77 @@
+package arrow
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies a to b and b to a until both directions are done. A finished
+// direction is half-closed so the peer sees EOF while the other one keeps
+// flowing; any error tears down both conns. It returns the bytes copied each
+// way and the first error.
+func relay(a, b net.Conn) (aToB, bToA int64, err error) {
+	var once sync.Once
+	fail := func(e error) {
+		once.Do(func() {
+			err = e
+			a.Close()
+			b.Close()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bToA = halfCopy(a, b, fail)
+	}()
+	aToB = halfCopy(b, a, fail)
+	wg.Wait()
+
+	a.Close()
+	b.Close()
+	return
+}
+
+// halfCopy prefers src.WriteTo or dst.ReadFrom, so ArrowConn and tcp conns
+// pick their fast paths; the pooled buffer is only used otherwise
+func halfCopy(dst, src net.Conn, fail func(error)) (n int64) {
+	buf := getBuf()
+	defer putBuf(buf)
+	n, err := io.CopyBuffer(dst, src, *buf)
+	if err == nil {
+		err = closeWrite(dst)
+	}
+	if err != nil {
+		fail(err)
+	}
+	return
+}
+
+// closeWrite sends FIN on c, or closes it when c can't half-close
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// bufferedConn reads through r first, for conns whose start was already
+// buffered while parsing
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,188 @@
+package arrow
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback tcp connection
+func tcpPair(t testing.TB) (client, server net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan net.Conn)
+	go func() {
+		c, _ := l.Accept()
+		done <- c
+	}()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, <-done
+}
+
+// arrowPair is tcpPair with both ends wrapped with method
+func arrowPair(t testing.TB, method string) (client, server net.Conn) {
+	c, s := tcpPair(t)
+	cc, _ := NewCipher(method, "pass")
+	sc, _ := NewCipher(method, "pass")
+	return NewArrowConn(c, cc, time.Minute), NewArrowConn(s, sc, time.Minute)
+}
+
+// tunnel wires user -> relay -> arrow pair -> relay -> origin and returns
+// both outer ends
+func tunnel(t testing.TB, method string) (user, origin net.Conn) {
+	user, local := tcpPair(t)
+	tunnelIn, tunnelOut := arrowPair(t, method)
+	remote, origin := tcpPair(t)
+	go relay(local, tunnelIn)
+	go relay(tunnelOut, remote)
+	return
+}
+
+// TestRelayHalfClose plays a client sending a request then FIN, and an origin
+// answering only after seeing EOF, through client -> relay -> tunnel -> relay -> origin
+func TestRelayHalfClose(t *testing.T) {
+	user, local := tcpPair(t)
+	tunnelIn, tunnelOut := arrowPair(t, DefaultMethod)
+	remote, origin := tcpPair(t)
+
+	type result struct {
+		up, down int64
+		err      error
+	}
+	results := make(chan result, 2)
+	go func() {
+		up, down, err := relay(local, tunnelIn)
+		results <- result{up, down, err}
+	}()
+	go func() {
+		up, down, err := relay(tunnelOut, remote)
+		results <- result{up, down, err}
+	}()
+
+	go func() {
+		req, err := ioutil.ReadAll(origin)
+		if err != nil {
+			t.Error(err)
+		}
+		origin.Write(append([]byte("got "), req...))
+		origin.Close()
+	}()
+
+	user.Write([]byte("ping"))
+	user.(*net.TCPConn).CloseWrite()
+	user.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := ioutil.ReadAll(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != "got ping" {
+		t.Errorf("want 'got ping', got %q", res)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			if r.err != nil || r.up != 4 || r.down != 8 {
+				t.Errorf("want 4/8 bytes and no error, got %+v", r)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("relay not torn down")
+		}
+	}
+}
+
+func TestRelayError(t *testing.T) {
+	a, peerA := tcpPair(t)
+	b, peerB := tcpPair(t)
+	defer peerB.Close()
+
+	done := make(chan error)
+	go func() {
+		_, _, err := relay(a, b)
+		done <- err
+	}()
+	// reset instead of FIN
+	peerA.(*net.TCPConn).SetLinger(0)
+	peerA.Write([]byte("x"))
+	peerA.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not torn down")
+	}
+	peerB.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(peerB); err != nil {
+		t.Error("peer of the other side should be closed", err)
+	}
+}
+
+func TestTunnelMethods(t *testing.T) {
+	for _, method := range []string{"none", "aes-128-cfb", DefaultMethod} {
+		user, origin := tunnel(t, method)
+		payload := bytes.Repeat([]byte("0123456789"), 100*1024)
+		go func() {
+			user.Write(payload)
+			user.(*net.TCPConn).CloseWrite()
+		}()
+		origin.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, err := ioutil.ReadAll(origin)
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("%s: payload corrupted, got %d bytes, err: %v", method, len(got), err)
+		}
+		user.Close()
+		origin.Close()
+	}
+}
+
+// benchmarkTunnel pushes 1MB per op through the whole relay path
+func benchmarkTunnel(b *testing.B, method string) {
+	user, origin := tunnel(b, method)
+	defer user.Close()
+	defer origin.Close()
+
+	payload := make([]byte, 1<<20)
+	go io.Copy(ioutil.Discard, origin)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := user.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTunnelNone(b *testing.B) {
+	benchmarkTunnel(b, "none")
+}
+
+func BenchmarkTunnelAES256CFB(b *testing.B) {
+	benchmarkTunnel(b, DefaultMethod)
+}
+
+func BenchmarkArrowConnWrite(b *testing.B) {
+	c, s := arrowPair(b, DefaultMethod)
+	defer c.Close()
+	defer s.Close()
+
+	payload := make([]byte, 1<<20)
+	go io.Copy(ioutil.Discard, s)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
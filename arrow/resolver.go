@@ -0,0 +1,442 @@
+package arrow
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDNSCacheSize bounds the cached names
+	DefaultDNSCacheSize = 4096
+	// DefaultDNSNegativeTTL caches failed lookups without SOA ttl
+	DefaultDNSNegativeTTL = 30 * time.Second
+	// systemDNSTTL caches lookups of the system resolver, which has no ttl
+	systemDNSTTL = 60 * time.Second
+
+	dnsMaxUDPSize = 4096
+)
+
+// DNSConfig of the server side resolver
+type DNSConfig struct {
+	// Upstreams are udp://ip:port, tcp://ip:port, tls://host:port or
+	// https://host/path urls, the system resolver is used when empty
+	Upstreams []string `yaml:"upstreams,omitempty"`
+	// Hosts are static overrides, name -> ips
+	Hosts       map[string][]string `yaml:"hosts,omitempty"`
+	CacheSize   int                 `yaml:"cache-size,omitempty"`
+	NegativeTTL time.Duration       `yaml:"negative-ttl,omitempty"`
+	Timeout     time.Duration       `yaml:"timeout,omitempty"`
+
+	// Listen makes the client serve dns (udp and tcp) resolved by the server
+	Listen string `yaml:"listen,omitempty"`
+	// Local are domains the client resolves itself through LocalUpstreams,
+	// or the system resolver when empty
+	Local          []string `yaml:"local,omitempty"`
+	LocalUpstreams []string `yaml:"local-upstreams,omitempty"`
+}
+
+// dnsUpstream sends a raw query and returns the raw response
+type dnsUpstream func(ctx context.Context, query []byte) ([]byte, error)
+
+type dnsCacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	msg     []byte
+	err     error
+	expires time.Time
+}
+
+// dnsCache holds up to size entries until they expire
+type dnsCache struct {
+	size    int
+	mu      sync.Mutex
+	entries map[dnsCacheKey]*dnsCacheEntry
+}
+
+// Resolver looks up names through the configured upstreams in order,
+// caching answers for their ttl and failures for the negative ttl
+type Resolver struct {
+	upstreams   []dnsUpstream
+	hosts       map[string][]net.IP
+	negativeTTL time.Duration
+	timeout     time.Duration
+	cache       *dnsCache
+}
+
+// NewResolver validates c and returns its resolver
+func NewResolver(c DNSConfig) (r *Resolver, err error) {
+	r = &Resolver{
+		hosts:       make(map[string][]net.IP),
+		negativeTTL: c.NegativeTTL,
+		timeout:     c.Timeout,
+		cache:       newDNSCache(c.CacheSize),
+	}
+	if r.negativeTTL == 0 {
+		r.negativeTTL = DefaultDNSNegativeTTL
+	}
+	if r.timeout == 0 {
+		r.timeout = DIAL_TIMEOUT
+	}
+	for name, ips := range c.Hosts {
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid ip of dns.hosts.%s: %s", name, s)
+			}
+			key := strings.ToLower(strings.TrimSuffix(name, "."))
+			r.hosts[key] = append(r.hosts[key], ip)
+		}
+	}
+	for _, s := range c.Upstreams {
+		u, err := newDNSUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	return
+}
+
+// LookupIP returns the A and AAAA records of host
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ips, ok := r.hosts[host]; ok {
+		return ips, nil
+	}
+	if len(r.upstreams) == 0 {
+		return r.lookupSystem(ctx, host)
+	}
+
+	var v4, v6 []net.IP
+	var err4, err6 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v6, _, err6 = r.lookup(ctx, host, dnsTypeAAAA)
+	}()
+	v4, _, err4 = r.lookup(ctx, host, dnsTypeA)
+	wg.Wait()
+
+	// v4 is shared with the cache, appending to it could write there
+	ips := make([]net.IP, 0, len(v4)+len(v6))
+	ips = append(append(ips, v4...), v6...)
+	if len(ips) == 0 {
+		if err4 != nil {
+			return nil, err4
+		}
+		if err6 != nil {
+			return nil, err6
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	return ips, nil
+}
+
+// lookup answers one name and type from cache or upstreams, along with the
+// ttl left
+func (r *Resolver) lookup(ctx context.Context, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	key := dnsCacheKey{host, qtype}
+	if e := r.cache.get(key); e != nil {
+		return e.ips, e.expires.Sub(time.Now()), e.err
+	}
+
+	ips, ttl, err := r.query(ctx, host, qtype)
+	if nerr, ok := err.(*net.DNSError); ok && nerr.Temporary() {
+		// upstreams failing isn't an answer worth caching
+		return nil, 0, err
+	}
+	if len(ips) == 0 && ttl == 0 {
+		ttl = r.negativeTTL
+	}
+	r.cache.put(key, &dnsCacheEntry{ips: ips, err: err, expires: time.Now().Add(ttl)})
+	return ips, ttl, err
+}
+
+// Answer responds to a raw query. A and AAAA go through the cache, other
+// types are relayed to the upstreams as is.
+func (r *Resolver) Answer(ctx context.Context, query []byte) ([]byte, error) {
+	_, q, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil, err
+	}
+	if q.class != dnsClassINET || q.qtype != dnsTypeA && q.qtype != dnsTypeAAAA {
+		if len(r.upstreams) == 0 {
+			return buildDNSResponse(query, nil, 0, dnsRcodeNotImp)
+		}
+		return r.Exchange(ctx, query)
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(q.name, "."))
+	var ips []net.IP
+	ttl := systemDNSTTL
+	if static, ok := r.hosts[host]; ok {
+		ips = static
+	} else if len(r.upstreams) > 0 {
+		ips, ttl, err = r.lookup(ctx, host, q.qtype)
+	} else {
+		ips, err = r.lookupSystem(ctx, host)
+	}
+	if nerr, ok := err.(*net.DNSError); ok && !nerr.Temporary() {
+		return buildDNSResponse(query, nil, uint32(ttl/time.Second), dnsRcodeNXDomain)
+	}
+	if err != nil {
+		return buildDNSResponse(query, nil, 0, dnsRcodeServFail)
+	}
+	return buildDNSResponse(query, ips, uint32(ttl/time.Second), dnsRcodeSuccess)
+}
+
+// query asks every upstream in turn until one answers
+func (r *Resolver) query(ctx context.Context, host string, qtype uint16) (ips []net.IP, ttl time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	q, err := buildDNSQuery(randomDNSID(), host, qtype)
+	if err != nil {
+		return
+	}
+	for _, u := range r.upstreams {
+		var res []byte
+		var a *dnsAnswer
+		if res, err = u(ctx, q); err != nil {
+			err = &net.DNSError{Err: err.Error(), Name: host, IsTemporary: true}
+			continue
+		}
+		if a, err = parseDNSAnswer(res, qtype); err != nil {
+			err = &net.DNSError{Err: err.Error(), Name: host, IsTemporary: true}
+			continue
+		}
+		ttl = time.Duration(a.ttl) * time.Second
+		switch a.rcode {
+		case dnsRcodeSuccess:
+			return a.ips, ttl, nil
+		case dnsRcodeNXDomain:
+			return nil, ttl, &net.DNSError{Err: "no such host", Name: host}
+		default:
+			err = &net.DNSError{Err: fmt.Sprintf("server failure, rcode %d", a.rcode), Name: host, IsTemporary: true}
+		}
+	}
+	return
+}
+
+// Exchange forwards a raw query to the upstreams, for clients resolving
+// through the tunnel
+func (r *Resolver) Exchange(ctx context.Context, query []byte) (res []byte, err error) {
+	if len(r.upstreams) == 0 {
+		return nil, fmt.Errorf("No dns upstream configured")
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	for _, u := range r.upstreams {
+		if res, err = u(ctx, query); err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (r *Resolver) lookupSystem(ctx context.Context, host string) ([]net.IP, error) {
+	key := dnsCacheKey{host, 0}
+	if e := r.cache.get(key); e != nil {
+		return e.ips, e.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	if err == nil {
+		r.cache.put(key, &dnsCacheEntry{ips: ips, expires: time.Now().Add(systemDNSTTL)})
+	} else if nerr, ok := err.(*net.DNSError); ok && !nerr.Temporary() {
+		r.cache.put(key, &dnsCacheEntry{err: err, expires: time.Now().Add(r.negativeTTL)})
+	}
+	return ips, err
+}
+
+func newDNSCache(size int) *dnsCache {
+	if size == 0 {
+		size = DefaultDNSCacheSize
+	}
+	return &dnsCache{
+		size:    size,
+		entries: make(map[dnsCacheKey]*dnsCacheEntry),
+	}
+}
+
+func (c *dnsCache) get(key dnsCacheKey) *dnsCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return e
+}
+
+func (c *dnsCache) put(key dnsCacheKey, e *dnsCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		now := time.Now()
+		for k, v := range c.entries {
+			if now.After(v.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// still full, drop whatever comes first
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = e
+}
+
+func randomDNSID() uint16 {
+	var b [2]byte
+	io.ReadFull(rand.Reader, b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+func newDNSUpstream(s string) (dnsUpstream, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp":
+		return func(ctx context.Context, q []byte) ([]byte, error) {
+			return exchangeUDP(ctx, u.Host, q)
+		}, nil
+	case "tcp":
+		return func(ctx context.Context, q []byte) ([]byte, error) {
+			var d net.Dialer
+			c, err := d.DialContext(ctx, "tcp", u.Host)
+			if err != nil {
+				return nil, err
+			}
+			return exchangeStream(ctx, c, q)
+		}, nil
+	case "tls":
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, q []byte) ([]byte, error) {
+			var d net.Dialer
+			rc, err := d.DialContext(ctx, "tcp", u.Host)
+			if err != nil {
+				return nil, err
+			}
+			return exchangeStream(ctx, tls.Client(rc, &tls.Config{ServerName: host}), q)
+		}, nil
+	case "https":
+		client := &http.Client{}
+		return func(ctx context.Context, q []byte) ([]byte, error) {
+			return exchangeHTTPS(ctx, client, s, q)
+		}, nil
+	}
+	return nil, fmt.Errorf("Unsupported dns upstream: %s", s)
+}
+
+func exchangeUDP(ctx context.Context, addr string, q []byte) ([]byte, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	if _, err = c.Write(q); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxUDPSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// skip stray responses of other queries
+		if n < dnsHeaderLen || !bytes.Equal(buf[:2], q[:2]) {
+			continue
+		}
+		if buf[2]&0x02 != 0 {
+			// truncated, retry over tcp
+			tc, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			return exchangeStream(ctx, tc, q)
+		}
+		return buf[:n], nil
+	}
+}
+
+// exchangeStream sends q length prefixed as over tcp and closes c
+func exchangeStream(ctx context.Context, c net.Conn, q []byte) ([]byte, error) {
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	if err := writeFrame(c, q); err != nil {
+		return nil, err
+	}
+	return readFrame(c)
+}
+
+func exchangeHTTPS(ctx context.Context, client *http.Client, endpoint string, q []byte) ([]byte, error) {
+	// RFC 8484 asks for id 0 so responses stay cacheable
+	id := []byte{q[0], q[1]}
+	q = append([]byte{0, 0}, q[2:]...)
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(q))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH %s: %s", endpoint, res.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < dnsHeaderLen {
+		return nil, errDNSMsg
+	}
+	copy(body, id)
+	return body, nil
+}
@@ -0,0 +1,221 @@
+package arrow
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDNS answers A queries of example.com with 1.2.3.4, multi.test with
+// three A and one AAAA records and NXDOMAIN for anything else, counting the
+// queries it gets
+func fakeDNS(t *testing.T, queries *int32) (addr string, stop func()) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+			_, q, err := parseDNSQuestion(buf[:n])
+			if err != nil {
+				continue
+			}
+			var res []byte
+			switch {
+			case q.name == "example.com" && q.qtype == dnsTypeA:
+				res, _ = buildDNSResponse(buf[:n], []net.IP{net.ParseIP("1.2.3.4")}, 300, dnsRcodeSuccess)
+			case q.name == "multi.test" && q.qtype == dnsTypeA:
+				res, _ = buildDNSResponse(buf[:n], []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}, 300, dnsRcodeSuccess)
+			case q.name == "multi.test" && q.qtype == dnsTypeAAAA:
+				res, _ = buildDNSResponse(buf[:n], []net.IP{net.ParseIP("fd00::1")}, 300, dnsRcodeSuccess)
+			case q.name == "example.com" || q.name == "multi.test":
+				res, _ = buildDNSResponse(buf[:n], nil, 0, dnsRcodeSuccess)
+			default:
+				res, _ = buildDNSResponse(buf[:n], nil, 0, dnsRcodeNXDomain)
+			}
+			c.WriteTo(res, from)
+		}
+	}()
+	return c.LocalAddr().String(), func() { c.Close() }
+}
+
+func TestResolver(t *testing.T) {
+	var queries int32
+	addr, stop := fakeDNS(t, &queries)
+	defer stop()
+
+	r, err := NewResolver(DNSConfig{
+		Upstreams: []string{"udp://" + addr},
+		Hosts:     map[string][]string{"static.test": {"10.0.0.1", "::1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		ips, err := r.LookupIP(ctx, "Example.com.")
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("1.2.3.4")) {
+			t.Fatal("wrong answer", ips, err)
+		}
+	}
+	// A and AAAA once each, then from cache
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("want 2 queries, got %d", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupIP(ctx, "missing.test"); err == nil {
+			t.Error("missing.test should not resolve")
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 4 {
+		t.Errorf("negative answers should be cached, got %d queries", n)
+	}
+
+	ips, err := r.LookupIP(ctx, "static.test")
+	if err != nil || len(ips) != 2 {
+		t.Error("static hosts not used", ips, err)
+	}
+}
+
+func TestResolverConcurrentLookups(t *testing.T) {
+	var queries int32
+	addr, stop := fakeDNS(t, &queries)
+	defer stop()
+	r, err := NewResolver(DNSConfig{Upstreams: []string{"udp://" + addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := r.LookupIP(ctx, "multi.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// answered from the cached slices, with room left after the A records
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, err := r.LookupIP(ctx, "multi.test")
+			if err != nil || len(ips) != 4 || !ips[3].Equal(net.ParseIP("fd00::1")) {
+				t.Error("wrong answer", ips, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestParseDNSAnswerNegativeTTL(t *testing.T) {
+	q, _ := buildDNSQuery(1, "missing.test", dnsTypeA)
+	res, _ := buildDNSResponse(q, nil, 0, dnsRcodeNXDomain)
+	// one authority SOA with ttl 3600 and minimum 60
+	binary.BigEndian.PutUint16(res[8:], 1)
+	rdata := append([]byte{0, 0}, make([]byte, 20)...)
+	binary.BigEndian.PutUint32(rdata[len(rdata)-4:], 60)
+	res = append(res, 0xC0, dnsHeaderLen, 0, dnsTypeSOA, 0, dnsClassINET, 0, 0, 0x0E, 0x10, 0, byte(len(rdata)))
+	res = append(res, rdata...)
+
+	a, err := parseDNSAnswer(res, dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.rcode != dnsRcodeNXDomain || a.ttl != 60 || len(a.ips) != 0 {
+		t.Errorf("want NXDOMAIN with ttl 60, got %+v", a)
+	}
+}
+
+func TestResolverUpstreamDown(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+	r, _ := NewResolver(DNSConfig{Upstreams: []string{"tcp://" + addr}, Timeout: time.Second})
+	if _, err := r.LookupIP(context.Background(), "example.com"); err == nil {
+		t.Error("should fail with upstream down")
+	}
+	if len(r.cache.entries) != 0 {
+		t.Error("upstream failures should not be cached")
+	}
+}
+
+func TestDNSTunnelDuplicateResponses(t *testing.T) {
+	c, server := net.Pipe()
+	defer server.Close()
+	first, second := make(chan []byte, 1), make(chan []byte, 1)
+	tunnel := &dnsTunnel{conn: c, pending: map[uint16]chan []byte{1: first, 2: second}}
+	go tunnel.read(c)
+
+	res := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(res, 1)
+	server.SetWriteDeadline(time.Now().Add(time.Second))
+	// the waiter of id 1 is gone, its answers must not block the reader
+	for i := 0; i < 3; i++ {
+		if err := writeFrame(server, res); err != nil {
+			t.Fatal("reader stuck:", err)
+		}
+	}
+	binary.BigEndian.PutUint16(res, 2)
+	if err := writeFrame(server, res); err != nil {
+		t.Fatal("reader stuck:", err)
+	}
+	select {
+	case <-second:
+	case <-time.After(time.Second):
+		t.Fatal("response of id 2 was not delivered")
+	}
+}
+
+func TestDNSProxy(t *testing.T) {
+	var queries int32
+	addr, stop := fakeDNS(t, &queries)
+	defer stop()
+
+	c := &Config{DNS: DNSConfig{Upstreams: []string{"udp://" + addr}}}
+	cc, _, stopArrow := startArrow(t, c)
+	defer stopArrow()
+	cc.DNS.Hosts = map[string][]string{"static.test": {"10.0.0.1"}}
+	p, err := NewDNSProxy(cc, getLogger("test", "error"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for i, id := range []uint16{7, 8} {
+		q, _ := buildDNSQuery(id, "example.com", dnsTypeA)
+		res, err := p.Answer(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := binary.BigEndian.Uint16(res); got != id {
+			t.Errorf("response id %d, want %d", got, id)
+		}
+		a, err := parseDNSAnswer(res, dnsTypeA)
+		if err != nil || len(a.ips) != 1 || !a.ips[0].Equal(net.ParseIP("1.2.3.4")) {
+			t.Fatal("wrong answer", i, a, err)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("want 1 upstream query, got %d", n)
+	}
+
+	// static hosts never reach the tunnel
+	q, _ := buildDNSQuery(9, "static.test", dnsTypeA)
+	res, err := p.Answer(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := parseDNSAnswer(res, dnsTypeA); a == nil || len(a.ips) != 1 || !a.ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Error("wrong static answer", a)
+	}
+}
@@ -0,0 +1,329 @@
+package arrow
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reverse tunnels, like ssh -R: a client registers over a control tunnel
+// and the server listens on its behalf. Every conn accepted there is
+// announced on the control tunnel by a random id, and the client claims it
+// by opening a data tunnel to reverseConnPrefix+id.
+const (
+	reverseTunnelHost = "reverse:"
+	reverseConnPrefix = "reverse-conn:"
+
+	// DefaultReverseMaxTunnels caps reverse tunnels registered on a server
+	DefaultReverseMaxTunnels = 16
+	// DefaultReverseMaxConns caps the concurrent conns of one reverse tunnel
+	DefaultReverseMaxConns = 64
+
+	reverseOK    = 0
+	reverseError = 1
+
+	// reverseRetry is how long a client waits before registering again
+	reverseRetry = 5 * time.Second
+)
+
+// allowReversePort reports whether port is in one of config.reverse-ports
+func (c *Config) allowReversePort(port int) bool {
+	for _, p := range c.ReversePorts {
+		lo, hi, err := parsePortRange(p)
+		if err == nil && port >= lo && port <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePortRange(s string) (lo, hi int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if lo, err = strconv.Atoi(strings.TrimSpace(parts[0])); err != nil {
+		return 0, 0, fmt.Errorf("Invalid port range: %s", s)
+	}
+	hi = lo
+	if len(parts) == 2 {
+		if hi, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return 0, 0, fmt.Errorf("Invalid port range: %s", s)
+		}
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("Invalid port range: %s", s)
+	}
+	return
+}
+
+// reverseRegistry tracks the reverse tunnels of a server and the accepted
+// conns waiting for their data tunnel
+type reverseRegistry struct {
+	mu      sync.Mutex
+	tunnels int
+	pending map[string]net.Conn
+}
+
+func (r *reverseRegistry) register(max int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tunnels >= max {
+		return false
+	}
+	r.tunnels++
+	return true
+}
+
+func (r *reverseRegistry) unregister() {
+	r.mu.Lock()
+	r.tunnels--
+	r.mu.Unlock()
+}
+
+func (r *reverseRegistry) put(id string, conn net.Conn) {
+	r.mu.Lock()
+	r.pending[id] = conn
+	r.mu.Unlock()
+}
+
+// take removes and returns the conn waiting for id
+func (r *reverseRegistry) take(id string) net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conn := r.pending[id]
+	delete(r.pending, id)
+	return conn
+}
+
+// handleReverse authenticates a registration, listens for the client and
+// announces accepted conns until the control tunnel fails
+func (s *Server) handleReverse(cConn net.Conn) {
+	setIdle(cConn, s.Idle)
+	msg, err := readFrame(cConn)
+	if err != nil {
+		return
+	}
+	parts := strings.SplitN(string(msg), "\x00", 2)
+	if len(parts) != 2 {
+		return
+	}
+	token, address := parts[0], parts[1]
+
+	l, err := s.reverseListen(token, address)
+	if err != nil {
+		s.logger.Errorln("Rejected reverse tunnel", address, ":", err)
+		writeFrame(cConn, append([]byte{reverseError}, err.Error()...))
+		return
+	}
+	defer s.reverse.unregister()
+	defer l.Close()
+	if err = writeFrame(cConn, append([]byte{reverseOK}, l.Addr().String()...)); err != nil {
+		return
+	}
+	s.logger.Infoln("Reverse tunnel listening at", l.Addr(), "for", cConn.RemoteAddr())
+
+	go func() {
+		// the client only sends pings, the tunnel is gone once they stop
+		for {
+			if _, err := readFrame(cConn); err != nil {
+				l.Close()
+				return
+			}
+		}
+	}()
+
+	sem := make(chan struct{}, s.ReverseMaxConns)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			s.logger.Debugln("Reverse tunnel at", l.Addr(), "done:", err)
+			return
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			s.logger.Errorln("Reverse tunnel at", l.Addr(), "has too many conns")
+			conn.Close()
+			continue
+		}
+		id := randomID()
+		s.reverse.put(id, &reverseConn{Conn: conn, release: func() { <-sem }})
+		if err = writeFrame(cConn, []byte(id)); err != nil {
+			s.reverse.take(id)
+			conn.Close()
+			<-sem
+			return
+		}
+		// unclaimed conns are dropped after the dial timeout
+		time.AfterFunc(s.Dial, func() {
+			if c := s.reverse.take(id); c != nil {
+				c.Close()
+			}
+		})
+	}
+}
+
+// reverseListen checks a registration and listens for it
+func (s *Server) reverseListen(token, address string) (net.Listener, error) {
+	if s.ReverseToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.ReverseToken)) != 1 {
+		return nil, fmt.Errorf("Reverse tunnel not authorized")
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || !s.allowReversePort(p) {
+		return nil, fmt.Errorf("Reverse tunnel port %s not allowed", port)
+	}
+	if !s.reverse.register(s.ReverseMaxTunnels) {
+		return nil, fmt.Errorf("Too many reverse tunnels")
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		s.reverse.unregister()
+		return nil, err
+	}
+	return l, nil
+}
+
+// handleReverseConn relays the data tunnel claiming id to its conn
+func (s *Server) handleReverseConn(cConn net.Conn, id string) {
+	conn := s.reverse.take(id)
+	if conn == nil {
+		s.logger.Errorln("No reverse conn waiting for", id)
+		return
+	}
+	defer conn.Close()
+	setIdle(cConn, s.Idle)
+	up, down, err := relay(cConn, conn)
+	s.logger.Debugln("Reverse conn", conn.RemoteAddr(), "done, up:", up, "down:", down, "err:", err)
+}
+
+// reverseConn gives back its slot of the reverse tunnel once closed
+type reverseConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *reverseConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// CloseWrite keeps half-close working through the wrapper
+func (c *reverseConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func randomID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// RunReverse keeps the reverse tunnel f registered, f.Listen being the
+// server address and f.To the local service, retrying when it fails
+func (c *Client) RunReverse(f Forward) error {
+	for {
+		err := c.registerReverse(f)
+		if rerr, ok := err.(reverseRejected); ok {
+			return rerr
+		}
+		c.logger.Errorln("Reverse tunnel", f.Listen, "failed, retrying:", err)
+		time.Sleep(reverseRetry)
+	}
+}
+
+// reverseRejected is the error the server answered a registration with
+type reverseRejected string
+
+func (e reverseRejected) Error() string {
+	return string(e)
+}
+
+// registerReverse registers f once and serves it until the control tunnel fails
+func (c *Client) registerReverse(f Forward) error {
+	ctl, err := Dial("tcp", c.Config)
+	if err != nil {
+		return err
+	}
+	defer ctl.Close()
+	if err = sendHost(ctl, reverseTunnelHost); err != nil {
+		return err
+	}
+	if err = writeFrame(ctl, []byte(c.ReverseToken+"\x00"+f.Listen)); err != nil {
+		return err
+	}
+	res, err := readFrame(ctl)
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 || res[0] != reverseOK {
+		if len(res) > 0 {
+			res = res[1:]
+		}
+		return reverseRejected(fmt.Sprintf("Reverse tunnel %s rejected: %s", f.Listen, res))
+	}
+	c.logger.Infoln("Reverse tunnel", string(res[1:]), "to", f.To)
+
+	var wmu sync.Mutex
+	done := make(chan struct{})
+	defer close(done)
+	if c.Idle > 0 {
+		go func() {
+			t := time.NewTicker(c.Idle / 3)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					wmu.Lock()
+					err := writeFrame(ctl, nil)
+					wmu.Unlock()
+					if err != nil {
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		id, err := readFrame(ctl)
+		if err != nil {
+			return err
+		}
+		go c.reverseConn(string(id), f.To)
+	}
+}
+
+// reverseConn claims the conn announced as id and relays it to the local
+// service
+func (c *Client) reverseConn(id, to string) {
+	local, err := net.DialTimeout("tcp", to, c.Dial)
+	if err != nil {
+		c.logger.Errorln("Error dialing reverse tunnel destination: ", err)
+		return
+	}
+	defer local.Close()
+	rConn, err := Dial("tcp", c.Config)
+	if err != nil {
+		return
+	}
+	defer rConn.Close()
+	if err = sendHost(rConn, reverseConnPrefix+id); err != nil {
+		return
+	}
+	up, down, err := relay(local, rConn)
+	c.logger.Debugln("Reverse conn to", to, "done, up:", up, "down:", down, "err:", err)
+}
@@ -0,0 +1,101 @@
+package arrow
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freePort returns a loopback address nothing listens on
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestReverseTunnel(t *testing.T) {
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	go func() {
+		for {
+			c, err := service.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	cc, _, stop := startArrow(t, &Config{
+		ReverseToken: "secret",
+		ReversePorts: []string{"1024-65535"},
+	})
+	defer stop()
+	public := freePort(t)
+	client := NewClient(cc).(*Client)
+	go client.RunReverse(Forward{Listen: public, To: service.Addr().String()})
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", public); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatal("no echo", string(b), err)
+	}
+}
+
+func TestReverseTunnelRejected(t *testing.T) {
+	cc, _, stop := startArrow(t, &Config{
+		ReverseToken: "secret",
+		ReversePorts: []string{"1024-65535"},
+	})
+	defer stop()
+	client := NewClient(cc).(*Client)
+
+	bad := *client.Config
+	bad.ReverseToken = "guess"
+	err := (&Client{Config: &bad, logger: client.logger}).RunReverse(Forward{Listen: freePort(t), To: "127.0.0.1:1"})
+	if err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Error("wrong token should be rejected, got", err)
+	}
+
+	err = client.RunReverse(Forward{Listen: "127.0.0.1:80", To: "127.0.0.1:1"})
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Error("port out of range should be rejected, got", err)
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	for s, want := range map[string][2]int{"8080": {8080, 8080}, "8000-8100": {8000, 8100}} {
+		lo, hi, err := parsePortRange(s)
+		if err != nil || lo != want[0] || hi != want[1] {
+			t.Errorf("%s: got %d-%d %v", s, lo, hi, err)
+		}
+	}
+	for _, s := range []string{"", "0", "9000-8000", "80-70000", "http"} {
+		if _, _, err := parsePortRange(s); err == nil {
+			t.Errorf("%s should not parse", s)
+		}
+	}
+}
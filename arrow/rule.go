@@ -0,0 +1,120 @@
+package arrow
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Values of Rule.Action
+const (
+	ActionProxy  = "proxy"
+	ActionDirect = "direct"
+)
+
+// Rule applies its settings to destinations matching any of Hosts
+type Rule struct {
+	// Hosts are domains (matching subdomains too), "*.domain" (subdomains
+	// only), IPs, CIDRs or "*" for everything
+	Hosts []string `yaml:"hosts"`
+	// Action is how the client reaches them, through the server by default
+	Action   string `yaml:"action,omitempty"`
+	Timeouts `yaml:",inline"`
+}
+
+// Match reports whether host (with or without port) is covered by r
+func (r *Rule) Match(host string) bool {
+	host = stripPort(host)
+	for _, p := range r.Hosts {
+		if matchHost(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Direct reports whether the client skips the server for r
+func (r *Rule) Direct() bool {
+	return r.Action == ActionDirect
+}
+
+// ruleFor returns the index of the first rule matching host, -1 if none
+func (c *Config) ruleFor(host string) int {
+	for i := range c.Rules {
+		if c.Rules[i].Match(host) {
+			return i
+		}
+	}
+	return -1
+}
+
+// forHost returns the config to use for host, c itself when no rule matches
+func (c *Config) forHost(host string) *Config {
+	return c.forRule(c.ruleFor(host))
+}
+
+// forRule returns c with the timeouts of rule i, c itself for -1
+func (c *Config) forRule(i int) *Config {
+	if i < 0 {
+		return c
+	}
+	cc := *c
+	cc.Timeouts = c.Timeouts.merge(c.Rules[i].Timeouts)
+	return &cc
+}
+
+// forDest is forHost for a destination about to be dialed, IP and CIDR
+// patterns also match the addresses a host name resolves to
+func (c *Config) forDest(host string, lookup func(context.Context, string) ([]net.IP, error)) *Config {
+	name := stripPort(host)
+	var ips []net.IP
+	resolved := net.ParseIP(name) != nil
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		match := r.Match(host)
+		if !match && !resolved && r.hasIPs() {
+			ips, _ = lookup(context.Background(), name)
+			resolved = true
+		}
+		for _, ip := range ips {
+			match = match || r.Match(ip.String())
+		}
+		if match {
+			return c.forRule(i)
+		}
+	}
+	return c
+}
+
+func (r *Rule) hasIPs() bool {
+	for _, p := range r.Hosts {
+		if strings.Contains(p, "/") || net.ParseIP(p) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if pattern == "*" || pattern == host {
+		return true
+	}
+	if strings.Contains(pattern, "/") {
+		_, n, err := net.ParseCIDR(pattern)
+		ip := net.ParseIP(host)
+		return err == nil && ip != nil && n.Contains(ip)
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return strings.HasSuffix(host, "."+pattern)
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
@@ -0,0 +1,49 @@
+package arrow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRuleMatch(t *testing.T) {
+	r := &Rule{Hosts: []string{"example.com", "*.internal", "10.0.0.0/8", "::1"}}
+	for host, want := range map[string]bool{
+		"example.com:443":     true,
+		"api.example.com":     true,
+		"badexample.com":      false,
+		"db.internal:5432":    true,
+		"internal":            false,
+		"10.1.2.3:80":         true,
+		"11.1.2.3":            false,
+		"[::1]:443":           true,
+		"EXAMPLE.com":         true,
+		"example.com.evil.io": false,
+	} {
+		if r.Match(host) != want {
+			t.Errorf("%s: want %v", host, want)
+		}
+	}
+}
+
+func TestConfigForHost(t *testing.T) {
+	c := &Config{
+		ServerTimeouts: Timeouts{Dial: 2 * time.Second},
+		Rules: []Rule{
+			{Hosts: []string{"slow.com"}, Timeouts: Timeouts{ResponseHeader: time.Minute}},
+		},
+	}
+	if err := c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	s := c.forSide(c.ServerTimeouts)
+	if s.Dial != 2*time.Second || s.Idle != IDLE_TIMEOUT {
+		t.Error("side timeouts not applied", s.Timeouts)
+	}
+	r := s.forHost("slow.com:80")
+	if r.ResponseHeader != time.Minute || r.Dial != 2*time.Second {
+		t.Error("rule timeouts not applied", r.Timeouts)
+	}
+	if s.forHost("fast.com") != s {
+		t.Error("no rule should match")
+	}
+}
@@ -1,21 +1,31 @@
 package arrow
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
-	"time"
-
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	raven "github.com/getsentry/raven-go"
-	"github.com/ibigbug/conn-pool/connpool"
 )
 
+// maxHostHeader bounds the destination header sent by clients
+const maxHostHeader = 1024
+
 // Server struct
 type Server struct {
 	*Config
 	logger   *logrus.Logger
-	connPool *connpool.ConnectionPool
+	connPool *ConnPool
+	resolver *Resolver
+	reverse  *reverseRegistry
+	auth     *ProxyAuth
 }
 
 // Run new server
@@ -24,14 +34,37 @@ func (s *Server) Run() (err error) {
 		s.logger.Fatal("config.server can not be nil")
 	}
 
-	l, err := ArrowListen("tcp4", s.ServerAddress, s.Password)
-	defer l.Close()
+	l, err := ArrowListen("tcp", s.Config)
 	checkError(err)
+	defer l.Close()
+	if s.ServerProxy != "" {
+		pl, err := net.Listen("tcp", s.ServerProxy)
+		checkError(err)
+		defer pl.Close()
+		s.logger.Infoln("Proxy running at: ", s.ServerProxy)
+		go func() {
+			if err := s.ServeProxy(pl); err != nil {
+				s.logger.Errorln("Error serving proxy: ", err)
+			}
+		}()
+	}
 
+	if s.Method == "none" {
+		s.logger.Warnln("CIPHER METHOD NONE: tunnels are neither encrypted nor authenticated, anyone reaching",
+			s.ServerAddress, "can relay through this server")
+	}
 	s.logger.Infoln("Server running at: ", s.ServerAddress)
+	return s.Serve(l)
+}
+
+// Serve handles conns accepted from an ArrowListener
+func (s *Server) Serve(l net.Listener) error {
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if nerr, ok := err.(net.Error); !ok || !nerr.Temporary() {
+				return err
+			}
 			raven.CaptureErrorAndWait(err, nil)
 			s.logger.Errorln("Accept error: ", err)
 			continue
@@ -42,61 +75,216 @@ func (s *Server) Run() (err error) {
 
 func (s *Server) handle(cConn net.Conn) {
 	defer cConn.Close()
-	var rConn *connpool.ManagedConn
 	rHost, err := s.peekHeader(cConn)
 	s.logger.Infoln("rHost got:", rHost)
 	if err != nil {
-		cConn.Close() // no leak
 		s.logger.Errorln("Error reading header: ", err)
 		return
 	}
-	rConn, err = s.connPool.GetTimeout(rHost, 5*time.Second)
+	switch {
+	case rHost == dnsTunnelHost:
+		s.handleDNS(cConn)
+		return
+	case rHost == udpTunnelHost:
+		s.handleUDP(cConn)
+		return
+	case rHost == reverseTunnelHost:
+		s.handleReverse(cConn)
+		return
+	case strings.HasPrefix(rHost, reverseConnPrefix):
+		s.handleReverseConn(cConn, strings.TrimPrefix(rHost, reverseConnPrefix))
+		return
+	}
+	isHTTP := strings.HasPrefix(rHost, httpTunnelPrefix)
+	rHost = strings.TrimPrefix(rHost, httpTunnelPrefix)
+
+	config := s.forDest(rHost, s.resolver.LookupIP)
+	setIdle(cConn, config.Idle)
+	if isHTTP {
+		s.handleHTTP(cConn, rHost, config)
+		return
+	}
+
+	rConn, err := s.connPool.Get(rHost, config.Dial)
 	if err != nil {
 		// 'cause io.Copy not started yet
 		// Read/Write Deadline doesn't cover this case
-		cConn.Close() // no leak
 		raven.CaptureErrorAndWait(err, nil)
 		s.logger.Errorln("Error dialing to remote: ", err)
 		return
 	}
-	go pipeConn(cConn, rConn)
-	pipeConn(rConn, cConn)
-	// TODO: may reuse conn here
-	s.connPool.Remove(rConn)
+	config.setKeepAlive(rConn.Conn)
+	up, down, err := relay(cConn, rConn)
+	s.logger.Debugln(rHost, "done, up:", up, "down:", down, "err:", err)
+}
+
+// handleHTTP serves the plain HTTP/1.x requests of a tunnel one by one,
+// giving upstream conns back to the pool once a response is complete
+func (s *Server) handleHTTP(cConn net.Conn, rHost string, config *Config) {
+	br := bufio.NewReader(cConn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF {
+				s.logger.Debugln("Error reading request: ", err)
+			}
+			return
+		}
+		rConn, err := s.connPool.Get(rHost, config.Dial)
+		if err != nil {
+			raven.CaptureErrorAndWait(err, nil)
+			s.logger.Errorln("Error dialing to remote: ", err)
+			return
+		}
+		if !rConn.Reused() {
+			config.setKeepAlive(rConn.Conn)
+		}
+		// a stalled origin would block reading or writing it forever
+		rConn.SetTimeout(config.Idle)
+		s.logger.Debugln(req.Method, rHost, req.URL, "reused:", rConn.Reused())
+
+		res, reusable, err := roundTrip(rConn, req, cConn)
+		if err != nil {
+			rConn.Close()
+			s.logger.Errorln("Error relaying request: ", err)
+			return
+		}
+
+		if res.StatusCode == http.StatusSwitchingProtocols {
+			err = res.Write(cConn)
+			if err == nil {
+				// the tunnel's idle timeout covers both sides from here
+				rConn.SetTimeout(0)
+				_, _, err = relay(&bufferedConn{cConn, br}, &bufferedConn{rConn.Conn, rConn.Reader})
+			}
+			s.logger.Debugln(rHost, "upgraded conn done, err:", err)
+			return
+		}
+
+		err = res.Write(cConn)
+		res.Body.Close()
+		if err != nil || !reusable || req.Close || res.Close {
+			rConn.Close()
+			if err != nil {
+				s.logger.Debugln("Error writing response: ", err)
+			}
+			return
+		}
+		rConn.SetTimeout(0)
+		s.connPool.Put(rConn)
+	}
+}
+
+// setIdle replaces the handshake deadline of a tunnel by the idle timeout
+func setIdle(c net.Conn, t time.Duration) {
+	if tc, ok := c.(interface{ SetTimeout(time.Duration) }); ok {
+		tc.SetTimeout(t)
+	}
+}
+
+// roundTrip sends req as received and reads its final response from c,
+// passing interim 1xx responses on to w. A body sent with Expect:
+// 100-continue is only read once the origin asks for it; when it answers
+// without, the user never sends the body and the conns are not reusable.
+func roundTrip(c *PoolConn, req *http.Request, w io.Writer) (res *http.Response, reusable bool, err error) {
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// stop Request.Write adding the Go default one
+		req.Header["User-Agent"] = []string{""}
+	}
+	expect := headerHasToken(req.Header, "Expect", "100-continue")
+	written := make(chan error, 1)
+	if expect {
+		go func() { written <- req.Write(c) }()
+	} else if err = req.Write(c); err != nil {
+		return
+	}
+
+	continued := false
+	for {
+		if res, err = http.ReadResponse(c.Reader, req); err != nil {
+			return
+		}
+		if res.StatusCode >= 200 || res.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+		continued = continued || res.StatusCode == http.StatusContinue
+		if err = writeInterim(w, res); err != nil {
+			return
+		}
+	}
+	if !expect {
+		return res, true, nil
+	}
+	if continued {
+		return res, <-written == nil, nil
+	}
+	select {
+	case err := <-written:
+		return res, err == nil, nil
+	default:
+		return res, false, nil
+	}
+}
+
+// writeInterim writes a 1xx response, which has no body
+func writeInterim(w io.Writer, res *http.Response) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/%d.%d %s\r\n", res.ProtoMajor, res.ProtoMinor, res.Status)
+	res.Header.Write(&b)
+	b.WriteString("\r\n")
+	_, err := w.Write(b.Bytes())
+	return err
 }
 
 func (s *Server) peekHeader(conn net.Conn) (host string, err error) {
+	if isShadowsocks(conn) {
+		// always host:port, the special hosts can't be asked for
+		return readSocksAddr(conn)
+	}
 	var size int64
 	err = binary.Read(conn, binary.LittleEndian, &size)
 	if err != nil {
 		return
 	}
-
-	defer func() {
-		err := recover()
-		if err != nil {
-			raven.CaptureErrorAndWait(err.(error), nil)
-			b := make([]byte, 8)
-			binary.LittleEndian.PutUint64(b, uint64(size))
-			s.logger.Errorln("Got wrong header:", b)
-		}
-	}()
+	if size <= 0 || size > maxHostHeader {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, uint64(size))
+		return "", fmt.Errorf("Got wrong header: %v", b)
+	}
 
 	header := make([]byte, size)
-	conn.Read(header)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
 	host = string(header[:])
 	return
 }
 
 // NewServer proxy server factory
 func NewServer(c *Config) (s Runnable) {
-	var logger = getLogger("server")
+	var logger = getLogger("server", c.LogLevel)
 
-	connPool := connpool.NewPool()
+	c = c.forSide(c.ServerTimeouts)
+	resolver, err := NewResolver(c.DNS)
+	checkError(err)
+	dialer := NewDialer(c)
+	dialer.LookupIP = resolver.LookupIP
+	connPool := NewConnPool(c.PoolMaxIdlePerHost, c.PoolMaxIdle, c.IdleConn)
+	connPool.Dial = dialer.Dial
+	egress, err := newEgressDialer(c, dialer)
+	checkError(err)
+	if egress != nil {
+		connPool.Dial = egress.Dial
+	}
+	auth, err := NewProxyAuth(c)
+	checkError(err)
 	s = &Server{
 		Config:   c,
 		logger:   logger,
-		connPool: &connPool,
+		connPool: connPool,
+		resolver: resolver,
+		reverse:  &reverseRegistry{pending: make(map[string]net.Conn)},
+		auth:     auth,
 	}
 	return
 }
@@ -0,0 +1,223 @@
+package arrow
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+)
+
+func init() {
+	raven.SetDSN("")
+}
+
+// startArrow runs a server and a client on loopback, returning the client
+// config and the proxy url of the client
+func startArrow(t testing.TB, c *Config) (*Config, *url.URL, func()) {
+	c.Password = "test"
+	c.LogLevel = "error"
+	c.ServerAddress = "127.0.0.1:0"
+	if err := c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	sl, err := ArrowListen("tcp", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := *c
+	cc.ServerAddress = sl.Addr().String()
+	cl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewServer(c).(*Server).Serve(sl)
+	go NewClient(&cc).(*Client).Serve(cl)
+
+	u, _ := url.Parse("http://" + cl.Addr().String())
+	return &cc, u, func() {
+		sl.Close()
+		cl.Close()
+	}
+}
+
+// countingOrigin counts the tcp conns it accepts
+func countingOrigin(conns *int32) *httptest.Server {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	origin.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	origin.Start()
+	return origin
+}
+
+func TestProxyGet(t *testing.T) {
+	var conns int32
+	origin := countingOrigin(&conns)
+	defer origin.Close()
+	_, proxy, stop := startArrow(t, &Config{})
+	defer stop()
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+	for _, p := range []string{"/a", "/b"} {
+		res, err := client.Get(origin.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "hello "+p {
+			t.Errorf("want 'hello %s', got %q", p, body)
+		}
+	}
+}
+
+func TestConnectEarlyData(t *testing.T) {
+	_, proxy, stop := startArrow(t, &Config{})
+	defer stop()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	for _, proto := range []string{"HTTP/1.0", "HTTP/1.1"} {
+		conn, err := net.Dial("tcp", proxy.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// like a client sending its ClientHello without waiting for 200
+		fmt.Fprintf(conn, "CONNECT %s %s\r\nHost: %[1]s\r\n\r\nearly", l.Addr(), proto)
+		br := bufio.NewReader(conn)
+		status, err := br.ReadString('\n')
+		if err != nil || !strings.HasPrefix(status, proto+" 200 ") {
+			t.Fatalf("want %s 200, got %q %v", proto, status, err)
+		}
+		br.ReadString('\n')
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(br, b); err != nil || string(b) != "early" {
+			t.Fatalf("%s: early data lost, got %q %v", proto, b, err)
+		}
+	}
+}
+
+func TestServerReusesUpstreamConns(t *testing.T) {
+	var conns int32
+	origin := countingOrigin(&conns)
+	defer origin.Close()
+	cc, _, stop := startArrow(t, &Config{})
+	defer stop()
+
+	host := strings.TrimPrefix(origin.URL, "http://")
+	for i := 0; i < 3; i++ {
+		c, err := Dial("tcp", cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setHTTPHost(c, host)
+		req, _ := http.NewRequest("GET", origin.URL+"/", nil)
+		req.Write(c)
+		res, err := http.ReadResponse(bufio.NewReader(c), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Close()
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("want 1 upstream conn, got %d", n)
+	}
+}
+
+func TestServerStalledOrigin(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	closed := make(chan struct{})
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// reads the request and never answers
+		io.Copy(ioutil.Discard, c)
+		close(closed)
+	}()
+	cc, _, stop := startArrow(t, &Config{Timeouts: Timeouts{Idle: 200 * time.Millisecond}})
+	defer stop()
+
+	c, err := Dial("tcp", cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	setHTTPHost(c, l.Addr().String())
+	req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+	req.Write(c)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream conn of a stalled origin was never closed")
+	}
+}
+
+func TestConnPoolHealthCheck(t *testing.T) {
+	var conns int32
+	origin := countingOrigin(&conns)
+	defer origin.Close()
+	host := strings.TrimPrefix(origin.URL, "http://")
+
+	p := NewConnPool(1, 1, 0)
+	c1, err := p.Get(host, DIAL_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, _ := p.Get(host, DIAL_TIMEOUT)
+	p.Put(c1)
+	// over the per host cap, closed
+	p.Put(c2)
+	if p.nIdle != 1 {
+		t.Errorf("want 1 idle conn, got %d", p.nIdle)
+	}
+
+	origin.CloseClientConnections()
+	c3, err := p.Get(host, DIAL_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c3.Reused() {
+		t.Error("conn closed by peer should not be reused")
+	}
+	p.Close()
+}
@@ -0,0 +1,137 @@
+package arrow
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ServeProxy serves standard HTTP and SOCKS5 proxy clients accepted from l,
+// told apart by their first byte. Their destinations are dialed like those
+// of tunnels.
+func (s *Server) ServeProxy(l net.Listener) error {
+	hl := &chanListener{
+		addr:  l.Addr(),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	defer hl.Close()
+	h := &ProxyHandler{
+		config: s.Config,
+		logger: s.logger,
+		auth:   s.auth,
+		dial:   s.dialDest,
+	}
+	go (&http.Server{Handler: h, IdleTimeout: s.Idle}).Serve(hl)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			return err
+		}
+		go func() {
+			conn.SetReadDeadline(time.Now().Add(s.Handshake))
+			br := bufio.NewReader(conn)
+			b, err := br.Peek(1)
+			conn.SetReadDeadline(time.Time{})
+			if err != nil {
+				conn.Close()
+				return
+			}
+			bc := &bufferedConn{conn, br}
+			if b[0] == socksVersion {
+				s.handleSocks(bc)
+				return
+			}
+			hl.push(bc)
+		}()
+	}
+}
+
+// handleSocks serves a SOCKS5 CONNECT, UDP ASSOCIATE is only offered by
+// the client
+func (s *Server) handleSocks(conn net.Conn) {
+	defer conn.Close()
+	if !s.auth.AllowIP(conn.RemoteAddr().String()) {
+		s.logger.Infoln("Refused", conn.RemoteAddr(), "not in config.auth-allow")
+		return
+	}
+	conn.SetDeadline(time.Now().Add(s.Handshake))
+	cmd, address, err := socksHandshake(conn, s.auth)
+	if err != nil {
+		s.logger.Debugln("Error negotiating socks: ", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.logger.Infoln("SOCKS", cmd, address)
+	if cmd != socksCmdConnect {
+		socksReply(conn, socksRepCmdNotSupported, nil)
+		return
+	}
+	rConn, err := s.dialDest(address)
+	if err != nil {
+		s.logger.Errorln("Error dialing to remote: ", err)
+		socksReply(conn, socksRepHostUnreachable, nil)
+		return
+	}
+	defer rConn.Close()
+	if err = socksReply(conn, socksRepSucceeded, nil); err != nil {
+		return
+	}
+	up, down, err := relay(conn, rConn)
+	s.logger.Debugln("SOCKS", address, "done, up:", up, "down:", down, "err:", err)
+}
+
+// dialDest connects to a destination of the proxy listener, through the
+// egress proxy when there is one
+func (s *Server) dialDest(rHost string) (net.Conn, error) {
+	rHost = ensurePort(rHost)
+	config := s.forDest(rHost, s.resolver.LookupIP)
+	rConn, err := s.connPool.Dial("tcp", rHost, config.Dial)
+	if err != nil {
+		return nil, err
+	}
+	config.setKeepAlive(rConn)
+	return rConn, nil
+}
+
+// chanListener hands the conns pushed to it to http.Server
+type chanListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *chanListener) push(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errListenerDone
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,159 @@
+package arrow
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// startServerProxy serves the proxy listener of a server requiring c's auth
+func startServerProxy(t *testing.T, c *Config) (addr string, stop func()) {
+	c.LogLevel = "error"
+	c.ServerProxy = "127.0.0.1:0"
+	if err := c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", c.ServerProxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewServer(c).(*Server).ServeProxy(l)
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestServerProxy(t *testing.T) {
+	var conns int32
+	origin := countingOrigin(&conns)
+	defer origin.Close()
+	echo := echoListener(t)
+	defer echo.Close()
+	addr, stop := startServerProxy(t, &Config{AuthUsers: []string{"ann:secret"}})
+	defer stop()
+
+	proxy := &url.URL{Scheme: "http", Host: addr}
+	res, err := proxyClient(proxy).Get(origin.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("want 407 without credentials, got %d", res.StatusCode)
+	}
+	// the pages of the client are not served on the public listener
+	for _, path := range []string{pacPath, statusPath} {
+		res, err := http.Get(proxy.String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: want 404, got %d", path, res.StatusCode)
+		}
+	}
+	proxy.User = url.UserPassword("ann", "secret")
+	res, err = proxyClient(proxy).Get(origin.URL + "/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "hello /plain" {
+		t.Errorf("want 'hello /plain', got %d %q", res.StatusCode, body)
+	}
+
+	// CONNECT and SOCKS5, spoken by the egress dialer
+	for _, scheme := range []string{"http", "socks5"} {
+		u, _ := parseEgress(scheme + "://ann:secret@" + addr)
+		e := &egressDialer{proxy: u, dialer: &Dialer{}}
+		conn, err := e.Dial("tcp", echo.Addr().String(), 5*time.Second)
+		if err != nil {
+			t.Fatal(scheme, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "ping")
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+			t.Errorf("%s: want ping echoed, got %q %v", scheme, b, err)
+		}
+		conn.Close()
+
+		u.User = url.UserPassword("ann", "wrong")
+		if _, err := e.Dial("tcp", echo.Addr().String(), 5*time.Second); err == nil {
+			t.Errorf("%s: wrong password accepted", scheme)
+		}
+	}
+}
+
+func TestEgress(t *testing.T) {
+	var conns int32
+	origin := countingOrigin(&conns)
+	defer origin.Close()
+	egress, stop := startServerProxy(t, &Config{AuthUsers: []string{"ann:secret"}})
+	defer stop()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	for egressURL, want := range map[string]int{
+		"socks5://ann:secret@" + egress:      http.StatusOK,
+		"http://ann:secret@" + egress:        http.StatusOK,
+		"socks5://" + closed.Addr().String(): http.StatusBadGateway,
+		"http://ann:wrong@" + egress:         http.StatusBadGateway,
+	} {
+		_, proxy, stop := startArrow(t, &Config{Egress: egressURL})
+		res, err := proxyClient(proxy).Get(origin.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Errorf("%s: want %d, got %d", egressURL, want, res.StatusCode)
+		}
+		stop()
+	}
+
+	for _, s := range []string{"ftp://a:1", "socks5://nohost", "http://[::1"} {
+		if err := (&Config{Egress: s}).Check(); err == nil {
+			t.Error("should fail:", s)
+		}
+	}
+	if err := (&Config{ServerProxy: ":1080"}).Check(); err == nil {
+		t.Error("server-proxy without auth should fail")
+	}
+}
+
+func TestEgressSocksReplyVersion(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.ReadFull(c, make([]byte, 3))
+		c.Write([]byte{socksVersion, socksMethodNoAuth})
+		io.ReadFull(c, make([]byte, 3))
+		readSocksAddr(c)
+		// a socks4 style reply, succeeded otherwise
+		c.Write([]byte{4, socksRepSucceeded, 0, 1, 127, 0, 0, 1, 0, 80})
+	}()
+
+	e, err := newEgressDialer(&Config{Egress: "socks5://" + l.Addr().String()}, NewDialer(&Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := e.Dial("tcp", "example.com:80", time.Second); err == nil {
+		conn.Close()
+		t.Error("reply of another socks version accepted")
+	}
+}
@@ -0,0 +1,253 @@
+package arrow
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Protocols spoken between client and server
+const (
+	// ProtocolGArrow is the native one, the default
+	ProtocolGArrow = "garrow"
+	// ProtocolShadowsocks is understood by standard shadowsocks clients and
+	// servers: the destination is sent as a socks address, and aead methods
+	// seal the stream in chunks
+	ProtocolShadowsocks = "shadowsocks"
+)
+
+const (
+	// ssMaxPayload is the largest payload of an aead chunk
+	ssMaxPayload = 0x3FFF
+	ssSubkeyInfo = "ss-subkey"
+)
+
+var errReplayed = errors.New("Replayed IV or salt")
+
+// isShadowsocks reports whether c is a tunnel of protocol shadowsocks
+func isShadowsocks(c net.Conn) bool {
+	switch c := c.(type) {
+	case *aeadConn:
+		return true
+	case *ArrowConn:
+		return c.shadowsocks
+	}
+	return false
+}
+
+// sendAddress sends the shadowsocks header, the destination as a socks
+// address. Plain HTTP tunnels are raw ones there, the other special hosts
+// have no equivalent.
+func sendAddress(rConn net.Conn, rHost string) error {
+	b, err := appendSocksAddr(nil, strings.TrimPrefix(rHost, httpTunnelPrefix))
+	if err != nil {
+		return fmt.Errorf("Protocol %s can't tunnel to %s", ProtocolShadowsocks, rHost)
+	}
+	_, err = rConn.Write(b)
+	return err
+}
+
+// evpBytesToKey derives the master key of password like OpenSSL's
+// EVP_BytesToKey with MD5, as every shadowsocks implementation does
+func evpBytesToKey(password string, keySize int) []byte {
+	var key, prev []byte
+	for len(key) < keySize {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keySize]
+}
+
+// aeadConn speaks the shadowsocks aead framing: a random salt, then chunks
+// of a sealed 2 bytes length and a sealed payload, each direction with its
+// own subkey and a little endian counter as nonce
+type aeadConn struct {
+	net.Conn
+	key     []byte
+	timeout time.Duration
+	replay  *replayFilter
+
+	enc, dec           cipher.AEAD
+	encNonce, decNonce []byte
+	wbuf, rbuf         []byte
+	// pending is what was opened and not read yet
+	pending []byte
+}
+
+func newAEADConn(conn net.Conn, key []byte, timeout time.Duration, replay *replayFilter) *aeadConn {
+	c := &aeadConn{
+		Conn:    conn,
+		key:     key,
+		timeout: timeout,
+		replay:  replay,
+	}
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+	return c
+}
+
+// newAEAD returns the cipher of the subkey derived from salt
+func (c *aeadConn) newAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey, err := hkdf.Key(sha1.New, c.key, salt, ssSubkeyInfo, len(c.key))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(subkey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *aeadConn) Read(b []byte) (n int, err error) {
+	if len(c.pending) == 0 {
+		if err = c.readChunk(); err != nil {
+			return
+		}
+	}
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return
+}
+
+// readChunk opens the next chunk into pending
+func (c *aeadConn) readChunk() error {
+	if c.dec == nil {
+		salt := make([]byte, len(c.key))
+		n, err := io.ReadFull(c.Conn, salt)
+		if n == 0 && err == io.EOF {
+			// peer half-closed without sending anything
+			return io.EOF
+		}
+		if err != nil {
+			return c.checkError(err)
+		}
+		if !c.replay.add(salt) {
+			return errReplayed
+		}
+		if c.dec, err = c.newAEAD(salt); err != nil {
+			return err
+		}
+		c.decNonce = make([]byte, c.dec.NonceSize())
+		c.rbuf = make([]byte, ssMaxPayload+c.dec.Overhead())
+	}
+
+	b := c.rbuf[:2+c.dec.Overhead()]
+	n, err := io.ReadFull(c.Conn, b)
+	if n == 0 && err == io.EOF {
+		return io.EOF
+	}
+	if err != nil {
+		return c.checkError(err)
+	}
+	l, err := c.open(b)
+	if err != nil {
+		return err
+	}
+	b = c.rbuf[:int(binary.BigEndian.Uint16(l))&ssMaxPayload+c.dec.Overhead()]
+	if _, err = io.ReadFull(c.Conn, b); err != nil {
+		return c.checkError(err)
+	}
+	if c.pending, err = c.open(b); err != nil {
+		return err
+	}
+	c.refresh()
+	return nil
+}
+
+func (c *aeadConn) open(b []byte) ([]byte, error) {
+	p, err := c.dec.Open(b[:0], c.decNonce, b, nil)
+	increment(c.decNonce)
+	return p, err
+}
+
+func (c *aeadConn) Write(b []byte) (n int, err error) {
+	if c.enc == nil {
+		salt := make([]byte, len(c.key))
+		if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+			return
+		}
+		// a server must not accept its own salts sent back to it either
+		c.replay.add(salt)
+		if c.enc, err = c.newAEAD(salt); err != nil {
+			return
+		}
+		c.encNonce = make([]byte, c.enc.NonceSize())
+		overhead := c.enc.Overhead()
+		c.wbuf = make([]byte, 0, len(salt)+2+overhead+ssMaxPayload+overhead)
+		c.wbuf = append(c.wbuf, salt...)
+	}
+
+	for n < len(b) {
+		size := len(b) - n
+		if size > ssMaxPayload {
+			size = ssMaxPayload
+		}
+		out := c.seal(c.wbuf, []byte{byte(size >> 8), byte(size)})
+		out = c.seal(out, b[n:n+size])
+		c.wbuf = c.wbuf[:0]
+		if _, err = c.Conn.Write(out); err != nil {
+			return n, c.checkError(err)
+		}
+		n += size
+		c.refresh()
+	}
+	return
+}
+
+func (c *aeadConn) seal(dst, plain []byte) []byte {
+	out := c.enc.Seal(dst, c.encNonce, plain, nil)
+	increment(c.encNonce)
+	return out
+}
+
+// increment adds one to the little endian counter b
+func increment(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *aeadConn) refresh() {
+	if c.timeout > 0 {
+		c.SetDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+// checkError closes the conn on fatal errors
+func (c *aeadConn) checkError(err error) error {
+	if nerr, ok := err.(net.Error); ok {
+		if !nerr.Temporary() || nerr.Timeout() {
+			c.Close()
+		}
+	}
+	return err
+}
+
+// CloseWrite half-closes the underlying conn, the stream simply ends
+// between two chunks
+func (c *aeadConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *aeadConn) SetTimeout(t time.Duration) {
+	c.timeout = t
+	c.refresh()
+}
@@ -0,0 +1,146 @@
+package arrow
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEVPBytesToKey(t *testing.T) {
+	// openssl enc -aes-256-cfb -k foobar -md md5 -nosalt -P
+	want := "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf"
+	if got := hex.EncodeToString(evpBytesToKey("foobar", 32)); got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+	if got := hex.EncodeToString(evpBytesToKey("foobar", 16)); got != want[:32] {
+		t.Errorf("want %s, got %s", want[:32], got)
+	}
+}
+
+func TestAEADConn(t *testing.T) {
+	salt := make([]byte, 32)
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	// openssl kdf -keylen 32 -kdfopt digest:SHA1 -kdfopt info:ss-subkey HKDF
+	subkey, _ := hex.DecodeString("c4f0e9818348b2f30188d82b37a4cddc9f5ea531070ec67225160209faff573c")
+	block, _ := aes.NewCipher(subkey)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	stream := gcm.Seal(append([]byte{}, salt...), nonce, []byte{0, 5}, nil)
+	nonce[0] = 1
+	stream = gcm.Seal(stream, nonce, []byte("hello"), nil)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		client.Write(stream)
+		client.Write(stream)
+	}()
+	replay := newReplayFilter()
+	c := newAEADConn(server, evpBytesToKey("foobar", 32), 0, replay)
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Fatalf("want hello, got %q %v", b, err)
+	}
+	// the same salt again
+	c = newAEADConn(server, evpBytesToKey("foobar", 32), 0, replay)
+	if _, err := c.Read(b); err != errReplayed {
+		t.Errorf("want %v, got %v", errReplayed, err)
+	}
+}
+
+func TestShadowsocksProxy(t *testing.T) {
+	var conns int32
+	origin := countingOrigin(&conns)
+	defer origin.Close()
+	l := echoListener(t)
+	defer l.Close()
+	for _, method := range []string{"aes-256-gcm", "aes-128-ctr", "aes-192-cfb", "none"} {
+		_, proxy, stop := startArrow(t, &Config{Protocol: ProtocolShadowsocks, Method: method})
+		client := proxyClient(proxy)
+		res, err := client.Get(origin.URL + "/ss")
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(body) != "hello /ss" {
+			t.Errorf("%s: got %d %q", method, res.StatusCode, body)
+		}
+
+		conn, err := net.Dial("tcp", proxy.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", l.Addr())
+		b := make([]byte, len("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		io.ReadFull(conn, b)
+		// bigger than one aead chunk
+		sent := bytes.Repeat([]byte("0123456789abcdef"), 2*ssMaxPayload/16)
+		go conn.Write(sent)
+		got := make([]byte, len(sent))
+		if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, sent) {
+			t.Errorf("%s: tunnel echoed %d bytes, err: %v", method, len(got), err)
+		}
+		conn.Close()
+		stop()
+	}
+}
+
+// recordConn keeps what is written instead of sending it
+type recordConn struct {
+	net.Conn
+	b bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	return c.b.Write(p)
+}
+
+func TestReplayRejected(t *testing.T) {
+	l := echoListener(t)
+	defer l.Close()
+	for _, protocol := range []string{ProtocolGArrow, ProtocolShadowsocks} {
+		for _, method := range []string{"aes-256-cfb", "aes-128-gcm"} {
+			if protocol == ProtocolGArrow && method == "aes-128-gcm" {
+				continue
+			}
+			c := &Config{Protocol: protocol, Method: method}
+			cc, _, stop := startArrow(t, c)
+
+			rec := &recordConn{}
+			tc, err := newTunnelConn(rec, cc, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setHost(tc, l.Addr().String())
+			tc.Write([]byte("hello"))
+
+			for i, want := range []string{"hello", ""} {
+				rc, err := net.Dial("tcp", cc.ServerAddress)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rc.SetDeadline(time.Now().Add(5 * time.Second))
+				rc.Write(rec.b.Bytes())
+				tc, _ := newTunnelConn(rc, cc, 0, nil)
+				got, _ := ioutil.ReadAll(io.LimitReader(tc, 5))
+				if string(got) != want {
+					t.Errorf("%s %s, try %d: want %q, got %q", protocol, method, i, want, got)
+				}
+				rc.Close()
+			}
+			stop()
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package arrow
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// sniffTimeout is how long a tunnel waits for the client to speak first,
+// protocols where the server does, like SMTP, are relayed after it
+const sniffTimeout = 300 * time.Millisecond
+
+// httpMethods start the plain HTTP requests sniffHost recognizes
+var httpMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"OPTIONS": true, "PATCH": true, "TRACE": true, "CONNECT": true,
+}
+
+// sniffed is what the first bytes of a tunnel tell about its destination
+type sniffed struct {
+	// name is the TLS server name or HTTP Host, without port
+	name string
+	// route is what rules are matched against, dial what the server is sent
+	route string
+	dial  string
+}
+
+// sniff peeks what the client sends first on a tunnel to dest when
+// config.sniff is set, returning conn replaying it. IP literal destinations
+// are routed by the name found, which is also dialed with
+// config.sniff-override.
+func (c *Config) sniff(conn net.Conn, dest string) (net.Conn, sniffed) {
+	s := sniffed{route: dest, dial: dest}
+	if !c.Sniff {
+		return conn, s
+	}
+	buf := make([]byte, sniffSize)
+	n := 0
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		host, more := sniffHost(buf[:n])
+		if host != "" || !more || err != nil {
+			s.name = host
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	conn = &bufferedConn{conn, io.MultiReader(bytes.NewReader(buf[:n]), conn)}
+
+	_, port, err := net.SplitHostPort(dest)
+	if s.name == "" || err != nil {
+		return conn, s
+	}
+	named := net.JoinHostPort(s.name, port)
+	if net.ParseIP(stripPort(dest)) != nil {
+		s.route = named
+	}
+	if c.SniffOverride {
+		s.route, s.dial = named, named
+	}
+	return conn, s
+}
+
+// sniffHost returns the TLS server name or HTTP Host named by the start of
+// a stream b, more is true while b is too short to tell
+func sniffHost(b []byte) (host string, more bool) {
+	if len(b) > 0 && b[0] == 0x16 {
+		if len(b) < 5 || len(b) < 5+int(binary.BigEndian.Uint16(b[3:5])) {
+			return "", true
+		}
+		return parseSNI(b), false
+	}
+	i := bytes.IndexByte(b, ' ')
+	if i < 0 {
+		for m := range httpMethods {
+			if bytes.HasPrefix([]byte(m), b) {
+				return "", true
+			}
+		}
+		return "", false
+	}
+	if !httpMethods[string(b[:i])] {
+		return "", false
+	}
+	if !bytes.Contains(b, []byte("\r\n\r\n")) {
+		return "", true
+	}
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return "", false
+	}
+	return stripPort(r.Host), false
+}
+
+// parseSNI returns the server name of the TLS ClientHello starting b,
+// empty when b holds no complete one or it names no server
+func parseSNI(b []byte) string {
+	// record header: handshake, version, length
+	if len(b) < 5 || b[0] != 0x16 {
+		return ""
+	}
+	n := int(binary.BigEndian.Uint16(b[3:5]))
+	b = b[5:]
+	if len(b) > n {
+		b = b[:n]
+	}
+	// handshake header: client hello, 24 bit length
+	if len(b) < 4 || b[0] != 0x01 {
+		return ""
+	}
+	b = b[4:]
+
+	// version and random
+	if len(b) < 34 {
+		return ""
+	}
+	b = b[34:]
+	var ok bool
+	// session id, cipher suites, compression methods
+	if b, ok = skipVector(b, 1); !ok {
+		return ""
+	}
+	if b, ok = skipVector(b, 2); !ok {
+		return ""
+	}
+	if b, ok = skipVector(b, 1); !ok {
+		return ""
+	}
+
+	if len(b) < 2 {
+		return ""
+	}
+	exts := b[2:]
+	if l := int(binary.BigEndian.Uint16(b)); l < len(exts) {
+		exts = exts[:l]
+	}
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts)
+		l := int(binary.BigEndian.Uint16(exts[2:]))
+		exts = exts[4:]
+		if l > len(exts) {
+			return ""
+		}
+		if typ == 0 {
+			return serverName(exts[:l])
+		}
+		exts = exts[l:]
+	}
+	return ""
+}
+
+// serverName reads the host_name of a server_name extension
+func serverName(b []byte) string {
+	if len(b) < 2 {
+		return ""
+	}
+	b = b[2:]
+	for len(b) >= 3 {
+		typ := b[0]
+		l := int(binary.BigEndian.Uint16(b[1:]))
+		b = b[3:]
+		if l > len(b) {
+			return ""
+		}
+		if typ == 0 {
+			return string(b[:l])
+		}
+		b = b[l:]
+	}
+	return ""
+}
+
+// skipVector drops a vector prefixed by a lenSize bytes length
+func skipVector(b []byte, lenSize int) ([]byte, bool) {
+	if len(b) < lenSize {
+		return nil, false
+	}
+	var l int
+	if lenSize == 1 {
+		l = int(b[0])
+	} else {
+		l = int(binary.BigEndian.Uint16(b))
+	}
+	b = b[lenSize:]
+	if l > len(b) {
+		return nil, false
+	}
+	return b[l:], true
+}
@@ -0,0 +1,132 @@
+package arrow
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSniffHost(t *testing.T) {
+	c, s := net.Pipe()
+	defer s.Close()
+	go tls.Client(c, &tls.Config{ServerName: "api.example.com"}).Handshake()
+	hello := make([]byte, sniffSize)
+	n, _ := s.Read(hello)
+	hello = hello[:n]
+
+	for _, tt := range []struct {
+		b    string
+		host string
+		more bool
+	}{
+		{string(hello), "api.example.com", false},
+		{string(hello[:40]), "", true},
+		{"GET / HTTP/1.1\r\nHost: a.example:8080\r\n\r\n", "a.example", false},
+		{"GET / HTTP/1.1\r\nHost: a.exa", "", true},
+		{"OPT", "", true},
+		{"SSH-2.0-OpenSSH_9.6\r\n", "", false},
+		{"\x00\x01\x02", "", false},
+	} {
+		host, more := sniffHost([]byte(tt.b))
+		if host != tt.host || more != tt.more {
+			t.Errorf("%q: want %q %v, got %q %v", tt.b, tt.host, tt.more, host, more)
+		}
+	}
+}
+
+func TestConfigSniff(t *testing.T) {
+	c := &Config{Sniff: true}
+	client, server := net.Pipe()
+	defer client.Close()
+	req := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	go io.WriteString(client, req)
+	conn, s := c.sniff(server, "127.0.0.1:80")
+	if s.name != "localhost" || s.route != "localhost:80" || s.dial != "127.0.0.1:80" {
+		t.Errorf("want localhost routed, 127.0.0.1 dialed, got %+v", s)
+	}
+	b := make([]byte, len(req))
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != req {
+		t.Errorf("sniffed bytes not replayed, got %q %v", b, err)
+	}
+
+	// a client waiting for the server to speak first
+	client, server = net.Pipe()
+	defer client.Close()
+	start := time.Now()
+	if _, s = c.sniff(server, "127.0.0.1:25"); s.name != "" || s.dial != "127.0.0.1:25" {
+		t.Errorf("want nothing sniffed, got %+v", s)
+	}
+	if d := time.Since(start); d > 2*sniffTimeout {
+		t.Errorf("sniffing a silent client took %s", d)
+	}
+}
+
+func TestSniffOverride(t *testing.T) {
+	_, proxy, stop := startArrow(t, &Config{Sniff: true, SniffOverride: true})
+	defer stop()
+	l := echoListener(t)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	conn, err := net.Dial("tcp", proxy.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// unreachable, only the sniffed name leads to the echo listener
+	dest := net.JoinHostPort("192.0.2.1", port)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", dest)
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(status, "HTTP/1.1 200 ") {
+		t.Fatalf("want 200, got %q %v", status, err)
+	}
+	br.ReadString('\n')
+
+	req := fmt.Sprintf("GET / HTTP/1.1\r\nHost: localhost:%s\r\n\r\n", port)
+	io.WriteString(conn, req)
+	b := make([]byte, len(req))
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != req {
+		t.Errorf("want the request echoed, got %q %v", b, err)
+	}
+}
+
+func TestSniffHostnameConnect(t *testing.T) {
+	// no server behind the client, every dial fails
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+	c := &Config{ServerAddress: dead.Addr().String(), LogLevel: "error", Sniff: true}
+	if err := c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go NewClient(c).(*Client).Serve(l)
+
+	for dest, want := range map[string]string{
+		// a host name is not sniffed, so the failed dial is still answered
+		"localhost:443": "HTTP/1.1 502 ",
+		"192.0.2.1:443": "HTTP/1.1 200 ",
+	} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", dest)
+		status, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if err != nil || !strings.HasPrefix(status, want) {
+			t.Errorf("%s: want %s, got %q %v", dest, want, status, err)
+		}
+	}
+}
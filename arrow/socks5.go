@@ -0,0 +1,357 @@
+package arrow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol values, RFC 1928
+const (
+	socksVersion = 5
+
+	socksMethodNoAuth       = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodNoAcceptable = 0xFF
+
+	// username/password subnegotiation, RFC 1929
+	socksUserPassVersion = 1
+
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksRepSucceeded        = 0
+	socksRepGeneralFailure   = 1
+	socksRepHostUnreachable  = 4
+	socksRepCmdNotSupported  = 7
+	socksRepAtypNotSupported = 8
+
+	// socksUDPHeaderLen is RSV and FRAG preceding the address of datagrams
+	socksUDPHeaderLen = 3
+	socksMaxUDPSize   = 64 * 1024
+)
+
+var (
+	errSocksAddr    = errors.New("Malformed socks address")
+	errSocksVersion = errors.New("Unsupported socks version")
+)
+
+// appendSocksAddr encodes host:port as ATYP, address and port
+func appendSocksAddr(b []byte, address string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, socksAtypIPv4), ip4...)
+		} else {
+			b = append(append(b, socksAtypIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errSocksAddr
+		}
+		b = append(append(b, socksAtypDomain, byte(len(host))), host...)
+	}
+	return append(b, byte(p>>8), byte(p)), nil
+}
+
+// parseSocksAddr decodes the address at the start of b, returning it as
+// host:port and its encoded length
+func parseSocksAddr(b []byte) (address string, n int, err error) {
+	if len(b) < 1 {
+		return "", 0, errSocksAddr
+	}
+	var host string
+	switch b[0] {
+	case socksAtypIPv4:
+		n = 1 + net.IPv4len
+		if len(b) < n+2 {
+			return "", 0, errSocksAddr
+		}
+		host = net.IP(b[1:n]).String()
+	case socksAtypIPv6:
+		n = 1 + net.IPv6len
+		if len(b) < n+2 {
+			return "", 0, errSocksAddr
+		}
+		host = net.IP(b[1:n]).String()
+	case socksAtypDomain:
+		if len(b) < 2 {
+			return "", 0, errSocksAddr
+		}
+		n = 2 + int(b[1])
+		if len(b) < n+2 {
+			return "", 0, errSocksAddr
+		}
+		host = string(b[2:n])
+	default:
+		return "", 0, errSocksAddr
+	}
+	port := binary.BigEndian.Uint16(b[n:])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), n + 2, nil
+}
+
+// readSocksAddr reads an encoded address from a stream
+func readSocksAddr(r io.Reader) (string, error) {
+	b := make([]byte, 2, 2+255+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	var l int
+	switch b[0] {
+	case socksAtypIPv4:
+		l = net.IPv4len - 1 + 2
+	case socksAtypIPv6:
+		l = net.IPv6len - 1 + 2
+	case socksAtypDomain:
+		l = int(b[1]) + 2
+	default:
+		return "", errSocksAddr
+	}
+	b = b[:2+l]
+	if _, err := io.ReadFull(r, b[2:]); err != nil {
+		return "", err
+	}
+	address, _, err := parseSocksAddr(b)
+	return address, err
+}
+
+// socksHandshake negotiates authentication, username/password when auth
+// needs credentials, and reads the request
+func socksHandshake(conn net.Conn, auth *ProxyAuth) (cmd byte, address string, err error) {
+	b := make([]byte, 255)
+	if _, err = io.ReadFull(conn, b[:2]); err != nil {
+		return
+	}
+	if b[0] != socksVersion {
+		return 0, "", errSocksVersion
+	}
+	methods := b[:b[1]]
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	want := byte(socksMethodNoAuth)
+	if auth != nil && auth.needsCredentials() {
+		want = socksMethodUserPass
+	}
+	method := byte(socksMethodNoAcceptable)
+	for _, m := range methods {
+		if m == want {
+			method = want
+		}
+	}
+	if _, err = conn.Write([]byte{socksVersion, method}); err != nil {
+		return
+	}
+	if method == socksMethodNoAcceptable {
+		return 0, "", fmt.Errorf("No acceptable socks auth method")
+	}
+	if method == socksMethodUserPass {
+		if err = socksUserPass(conn, auth); err != nil {
+			return
+		}
+	}
+
+	if _, err = io.ReadFull(conn, b[:3]); err != nil {
+		return
+	}
+	if b[0] != socksVersion {
+		return 0, "", errSocksVersion
+	}
+	cmd = b[1]
+	address, err = readSocksAddr(conn)
+	if err == errSocksAddr {
+		socksReply(conn, socksRepAtypNotSupported, nil)
+	}
+	return
+}
+
+// socksUserPass checks the credentials of the subnegotiation
+func socksUserPass(conn net.Conn, auth *ProxyAuth) error {
+	b := make([]byte, 256)
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != socksUserPassVersion {
+		return errSocksVersion
+	}
+	user := make([]byte, b[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return err
+	}
+	password := b[1 : 1+b[0]]
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+	if !auth.Verify(string(user), string(password)) {
+		conn.Write([]byte{socksUserPassVersion, 1})
+		return fmt.Errorf("Socks auth failed for %s", user)
+	}
+	_, err := conn.Write([]byte{socksUserPassVersion, 0})
+	return err
+}
+
+// socksReply answers a request with rep, bound to bind when given
+func socksReply(conn net.Conn, rep byte, bind net.Addr) error {
+	address := "0.0.0.0:0"
+	if bind != nil {
+		address = bind.String()
+	}
+	b, err := appendSocksAddr([]byte{socksVersion, rep, 0}, address)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+// ServeSocks proxies SOCKS5 CONNECT and UDP ASSOCIATE requests accepted from l
+func (c *Client) ServeSocks(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			return err
+		}
+		go c.handleSocks(conn)
+	}
+}
+
+func (c *Client) handleSocks(conn net.Conn) {
+	defer conn.Close()
+	if !c.auth.AllowIP(conn.RemoteAddr().String()) {
+		c.logger.Infoln("Refused", conn.RemoteAddr(), "not in config.auth-allow")
+		return
+	}
+	conn.SetDeadline(time.Now().Add(c.Handshake))
+	cmd, address, err := socksHandshake(conn, c.auth)
+	if err != nil {
+		c.logger.Debugln("Error negotiating socks: ", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	c.logger.Infoln("SOCKS", cmd, address)
+
+	switch cmd {
+	case socksCmdConnect:
+		c.socksConnect(conn, address)
+	case socksCmdUDPAssociate:
+		c.socksUDP(conn)
+	default:
+		socksReply(conn, socksRepCmdNotSupported, nil)
+	}
+}
+
+func (c *Client) socksConnect(conn net.Conn, address string) {
+	config, direct := c.stats.route(c.Config, address)
+	rConn, err := dialHost(config, address, direct)
+	if err != nil {
+		socksReply(conn, socksRepHostUnreachable, nil)
+		return
+	}
+	defer rConn.Close()
+	if err = socksReply(conn, socksRepSucceeded, nil); err != nil {
+		return
+	}
+	up, down, err := relay(conn, rConn)
+	c.logger.Debugln("SOCKS", address, "done, up:", up, "down:", down, "err:", err)
+}
+
+// socksUDP relays the datagrams of a UDP ASSOCIATE through a udp tunnel
+// until the control conn closes
+func (c *Client) socksUDP(conn net.Conn) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		socksReply(conn, socksRepGeneralFailure, nil)
+		return
+	}
+	defer pc.Close()
+	tunnel, err := dialUDPTunnel(c.Config)
+	if err != nil {
+		socksReply(conn, socksRepGeneralFailure, nil)
+		return
+	}
+	defer tunnel.Close()
+	if err = socksReply(conn, socksRepSucceeded, pc.LocalAddr()); err != nil {
+		return
+	}
+
+	// only the host holding the control conn may use the association
+	peerIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	peer := make(chan *net.UDPAddr, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer conn.Close()
+		var from *net.UDPAddr
+		buf := make([]byte, socksMaxUDPSize)
+		for {
+			n, addr, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !addr.IP.Equal(peerIP) {
+				continue
+			}
+			if from == nil {
+				from = addr
+				peer <- addr
+			}
+			// fragments are not supported, RFC 1928 allows dropping them
+			if n < socksUDPHeaderLen || buf[2] != 0 {
+				continue
+			}
+			if _, _, err := parseSocksAddr(buf[socksUDPHeaderLen:n]); err != nil {
+				continue
+			}
+			if err := writeFrame(tunnel, buf[socksUDPHeaderLen:n]); err != nil {
+				c.logger.Debugln("Error relaying datagram: ", err)
+				if err != errFrameTooLarge {
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		defer conn.Close()
+		var to *net.UDPAddr
+		for {
+			msg, err := readFrame(tunnel)
+			if err != nil {
+				return
+			}
+			if to == nil {
+				select {
+				case to = <-peer:
+				case <-done:
+					return
+				}
+			}
+			pc.WriteToUDP(append(make([]byte, socksUDPHeaderLen), msg...), to)
+		}
+	}()
+
+	io.Copy(ioutil.Discard, conn)
+	c.logger.Debugln("SOCKS udp association of", conn.RemoteAddr(), "done")
+}
@@ -0,0 +1,143 @@
+package arrow
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startSocks serves socks5 for a client of an arrow pair
+func startSocks(t *testing.T) (addr string, stop func()) {
+	cc, _, stopArrow := startArrow(t, &Config{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewClient(cc).(*Client).ServeSocks(l)
+	return l.Addr().String(), func() {
+		l.Close()
+		stopArrow()
+	}
+}
+
+// socksRequest negotiates no auth and sends cmd for address, returning the
+// bound address of the reply
+func socksRequest(t *testing.T, conn net.Conn, cmd byte, address string) string {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := appendSocksAddr([]byte{socksVersion, 1, socksMethodNoAuth, socksVersion, cmd, 0}, address)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b[:2]); err != nil || b[1] != socksMethodNoAuth {
+		t.Fatal("bad method reply", b, err)
+	}
+	if _, err := io.ReadFull(conn, b[:3]); err != nil || b[1] != socksRepSucceeded {
+		t.Fatal("bad reply", b, err)
+	}
+	bind, err := readSocksAddr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bind
+}
+
+func TestSocksAddr(t *testing.T) {
+	for _, addr := range []string{"1.2.3.4:80", "[2001:db8::1]:443", "example.com:53"} {
+		b, err := appendSocksAddr(nil, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, n, err := parseSocksAddr(append(b, "data"...))
+		if err != nil || got != addr || n != len(b) {
+			t.Errorf("%s: got %s %d %v", addr, got, n, err)
+		}
+	}
+	if _, _, err := parseSocksAddr([]byte{socksAtypDomain, 10, 'a'}); err == nil {
+		t.Error("short address should fail")
+	}
+}
+
+func TestSocksConnect(t *testing.T) {
+	addr, stop := startSocks(t)
+	defer stop()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	socksRequest(t, conn, socksCmdConnect, l.Addr().String())
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatal("no echo", string(b), err)
+	}
+}
+
+func TestSocksUDPAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+	addr, stop := startSocks(t)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bind := socksRequest(t, conn, socksCmdUDPAssociate, "0.0.0.0:0")
+
+	uc, err := net.Dial("udp", bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	uc.SetDeadline(time.Now().Add(5 * time.Second))
+	dg, _ := appendSocksAddr(make([]byte, socksUDPHeaderLen), echo.LocalAddr().String())
+	for _, payload := range []string{"one", "two"} {
+		if _, err := uc.Write(append(dg, payload...)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		n, err := uc.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from, m, err := parseSocksAddr(buf[socksUDPHeaderLen:n])
+		if err != nil || from != echo.LocalAddr().String() {
+			t.Fatal("wrong source", from, err)
+		}
+		if got := buf[socksUDPHeaderLen+m : n]; !bytes.Equal(got, []byte(payload)) {
+			t.Errorf("got %q, want %q", got, payload)
+		}
+	}
+}
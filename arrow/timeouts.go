@@ -0,0 +1,68 @@
+package arrow
+
+import (
+	"net"
+	"time"
+)
+
+// Timeouts of one side of the relay, zero means unset
+type Timeouts struct {
+	// Handshake is how long the server waits for the destination header
+	Handshake time.Duration `yaml:"handshake-timeout,omitempty"`
+	// Dial bounds connecting to the server (client) or the destination (server)
+	Dial time.Duration `yaml:"dial-timeout,omitempty"`
+	// Idle closes a relayed connection with no traffic for this long
+	Idle time.Duration `yaml:"idle-timeout,omitempty"`
+	// ResponseHeader bounds waiting for response headers of plain HTTP requests
+	ResponseHeader time.Duration `yaml:"response-header-timeout,omitempty"`
+	// IdleConn closes keep-alive HTTP connections unused for this long
+	IdleConn time.Duration `yaml:"idle-conn-timeout,omitempty"`
+	// KeepAlive is the TCP keepalive period, negative disables it
+	KeepAlive time.Duration `yaml:"keepalive,omitempty"`
+}
+
+var defaultTimeouts = Timeouts{
+	Handshake:      5 * time.Second,
+	Dial:           DIAL_TIMEOUT,
+	Idle:           IDLE_TIMEOUT,
+	ResponseHeader: 5 * time.Second,
+	IdleConn:       5 * time.Second,
+	KeepAlive:      30 * time.Second,
+}
+
+// merge returns t with every field set in o overridden
+func (t Timeouts) merge(o Timeouts) Timeouts {
+	if o.Handshake != 0 {
+		t.Handshake = o.Handshake
+	}
+	if o.Dial != 0 {
+		t.Dial = o.Dial
+	}
+	if o.Idle != 0 {
+		t.Idle = o.Idle
+	}
+	if o.ResponseHeader != 0 {
+		t.ResponseHeader = o.ResponseHeader
+	}
+	if o.IdleConn != 0 {
+		t.IdleConn = o.IdleConn
+	}
+	if o.KeepAlive != 0 {
+		t.KeepAlive = o.KeepAlive
+	}
+	return t
+}
+
+// setKeepAlive applies t.KeepAlive to a raw tcp conn
+func (t Timeouts) setKeepAlive(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if t.KeepAlive < 0 {
+		tc.SetKeepAlive(false)
+		return
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(t.KeepAlive)
+}
@@ -0,0 +1,173 @@
+package arrow
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// udpTunnelHost is sent instead of a destination to open a tunnel carrying
+// datagrams, each framed as a socks address followed by the payload. The
+// address is the destination going to the server and the source coming back.
+const udpTunnelHost = "udp:"
+
+// udpMaxPeers bounds the nat table of one association
+const udpMaxPeers = 1024
+
+// udpAssociation relays the datagrams of one udp tunnel through a single
+// socket. Like a restricted cone nat, replies are only let through from
+// peers a datagram was sent to within the idle timeout.
+type udpAssociation struct {
+	tunnel  net.Conn
+	pc      *net.UDPConn
+	timeout time.Duration
+	dialer  *Dialer
+
+	wmu   sync.Mutex
+	mu    sync.Mutex
+	peers map[string]time.Time
+}
+
+// handleUDP serves a udp tunnel until it fails or stays idle
+func (s *Server) handleUDP(cConn net.Conn) {
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		s.logger.Errorln("Error listening udp: ", err)
+		return
+	}
+	defer pc.Close()
+	setIdle(cConn, s.Idle)
+	dialer := NewDialer(s.Config)
+	dialer.LookupIP = s.resolver.LookupIP
+	a := &udpAssociation{
+		tunnel:  cConn,
+		pc:      pc,
+		timeout: s.Idle,
+		dialer:  dialer,
+		peers:   make(map[string]time.Time),
+	}
+	go a.replies()
+	err = a.forward()
+	s.logger.Debugln("udp association done, err:", err)
+}
+
+// forward sends the datagrams read from the tunnel to their destination
+func (a *udpAssociation) forward() error {
+	for {
+		msg, err := readFrame(a.tunnel)
+		if err != nil {
+			return err
+		}
+		dest, n, err := parseSocksAddr(msg)
+		if err != nil {
+			return err
+		}
+		addr, err := a.resolve(dest)
+		if err != nil {
+			continue
+		}
+		if !a.allow(addr) {
+			continue
+		}
+		a.pc.WriteToUDP(msg[n:], addr)
+	}
+}
+
+// replies sends the datagrams of known peers back through the tunnel
+func (a *udpAssociation) replies() {
+	buf := make([]byte, socksMaxUDPSize)
+	for {
+		n, from, err := a.pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !a.known(from) {
+			continue
+		}
+		msg, err := appendSocksAddr(make([]byte, 0, 19+n), peerKey(from))
+		if err != nil {
+			continue
+		}
+		a.wmu.Lock()
+		err = writeFrame(a.tunnel, append(msg, buf[:n]...))
+		a.wmu.Unlock()
+		if err != nil && err != errFrameTooLarge {
+			a.tunnel.Close()
+			return
+		}
+	}
+}
+
+func (a *udpAssociation) resolve(dest string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+	ips, err := a.dialer.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	primaries, _ := a.dialer.partition(ips)
+	if len(primaries) == 0 {
+		return nil, fmt.Errorf("No %s address for %s", a.dialer.Preference, host)
+	}
+	return &net.UDPAddr{IP: primaries[0], Port: p}, nil
+}
+
+// allow records addr in the nat table, false when the table is full
+func (a *udpAssociation) allow(addr *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := peerKey(addr)
+	if _, ok := a.peers[key]; !ok && len(a.peers) >= udpMaxPeers {
+		a.expire()
+		if len(a.peers) >= udpMaxPeers {
+			return false
+		}
+	}
+	a.peers[key] = time.Now()
+	return true
+}
+
+// known reports whether addr may send replies
+func (a *udpAssociation) known(addr *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := peerKey(addr)
+	t, ok := a.peers[key]
+	if ok && a.timeout > 0 && time.Since(t) > a.timeout {
+		delete(a.peers, key)
+		return false
+	}
+	return ok
+}
+
+// expire must be called with a.mu held
+func (a *udpAssociation) expire() {
+	if a.timeout <= 0 {
+		return
+	}
+	for key, t := range a.peers {
+		if time.Since(t) > a.timeout {
+			delete(a.peers, key)
+		}
+	}
+}
+
+// peerKey is addr as host:port, IPv4 in its short form whatever the socket
+func peerKey(addr *net.UDPAddr) string {
+	ip := addr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port))
+}
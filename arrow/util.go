@@ -2,14 +2,14 @@ package arrow
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"strings"
 
-	"io"
-
 	"github.com/Sirupsen/logrus"
 	raven "github.com/getsentry/raven-go"
 )
@@ -35,8 +35,26 @@ func checkError(err error) {
 		os.Exit(1)
 	}
 }
+
+// httpTunnelPrefix marks tunnels carrying only plain HTTP/1.x requests, the
+// server then parses them and reuses upstream conns. Servers older than it
+// fail to dial such destinations, nothing is negotiated.
+const httpTunnelPrefix = "http://"
+
+var errFrameTooLarge = errors.New("Frame too large")
+
 func setHost(rConn net.Conn, rHost string) (err error) {
-	rHost = ensurePort(rHost)
+	return sendHost(rConn, ensurePort(rHost))
+}
+
+func setHTTPHost(rConn net.Conn, rHost string) (err error) {
+	return sendHost(rConn, httpTunnelPrefix+ensurePort(rHost))
+}
+
+func sendHost(rConn net.Conn, rHost string) (err error) {
+	if isShadowsocks(rConn) {
+		return sendAddress(rConn, rHost)
+	}
 	err = binary.Write(rConn, binary.LittleEndian, int64(len(rHost)))
 	if err != nil {
 		return
@@ -46,18 +64,45 @@ func setHost(rConn net.Conn, rHost string) (err error) {
 	return
 }
 
-func pipeConn(dst, src net.Conn) {
-	r, w := io.Pipe()
-	go func() {
-		io.Copy(dst, r)
-	}()
-	io.Copy(w, src)
+// readFrame reads one uint16 length prefixed message, the framing of dns
+// and udp tunnels
+func readFrame(r io.Reader) ([]byte, error) {
+	var l uint16
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, l)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// writeFrame sends msg length prefixed in a single write
+func writeFrame(w io.Writer, msg []byte) error {
+	if len(msg) > 0xFFFF {
+		return errFrameTooLarge
+	}
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ensurePort defaults to port 80, bare or bracketed IPv6 literals included
+// isLoopback reports whether the host of address is a loopback one
+func isLoopback(address string) bool {
+	host := stripPort(address)
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func ensurePort(s string) (h string) {
 	h = s
-	if !strings.Contains(s, ":") {
-		h = fmt.Sprintf("%s:80", s)
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		h = net.JoinHostPort(strings.Trim(s, "[]"), "80")
 	}
 	return
 }
@@ -70,12 +115,15 @@ func writeHeader(w http.ResponseWriter, hdr http.Header) {
 	}
 }
 
-func getLogger(name string) *logrus.Logger {
+func getLogger(name, level string) *logrus.Logger {
 	var logger = logrus.New()
 	logger.Formatter = &logrus.TextFormatter{
 		DisableColors: true,
 	}
 	logger.Level = logrus.DebugLevel
+	if lvl, err := logrus.ParseLevel(level); err == nil {
+		logger.Level = lvl
+	}
 	logger.WithFields(logrus.Fields{
 		"from": "client",
 	})
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ibigbug/GArrow/arrow"
+)
+
+func runCA(args []string) {
+	fs := flag.NewFlagSet("ca", flag.ExitOnError)
+	var name = fs.String("name", "GArrow debugging CA", "Common name of the CA")
+	var out = fs.String("o", ".", "Write ca.pem and ca-key.pem into this directory")
+	fs.Parse(args)
+
+	certPEM, keyPEM, err := arrow.GenerateCA(*name)
+	exitOnError(err)
+	certFile, keyFile := filepath.Join(*out, "ca.pem"), filepath.Join(*out, "ca-key.pem")
+	if _, err := os.Stat(keyFile); err == nil {
+		exitOnError(fmt.Errorf("%s exists, remove it to replace the CA", keyFile))
+	}
+	exitOnError(ioutil.WriteFile(certFile, certPEM, 0644))
+	exitOnError(ioutil.WriteFile(keyFile, keyPEM, 0600))
+	fmt.Fprintln(os.Stderr, "Written", certFile, keyFile)
+	fmt.Fprintf(os.Stderr, `
+Trust %s in the browser or system of the apps to debug, keep %s private,
+and intercept only the hosts you are debugging:
+
+mitm-hosts: ['api.example.com']
+mitm-ca-cert: '%s'
+mitm-ca-key: '%s'
+`, certFile, keyFile, certFile, keyFile)
+}
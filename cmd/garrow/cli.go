@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/ibigbug/GArrow/arrow"
 )
@@ -12,24 +13,134 @@ import (
 const (
 	// VERSION App version
 	VERSION = "0.1.1"
+
+	defaultConfig = "g-arrow.yaml"
 )
 
+const usage = `Usage: garrow <command> [flags]
+
+Commands:
+  server          run the relay server
+  client          run the local proxy
+  keygen          generate a random key with matching server/client config
+  ca              generate the CA the client signs intercepted hosts with
+  config check    validate a config and print it with secrets redacted
+  url export      print the garrow:// uri of a client config
+  url import URI  print the client config of a garrow:// uri
+  version         print version and build info
+
+Run 'garrow <command> -h' for the flags of a command.
+`
+
 func main() {
-	var mode = flag.String("m", "client", "Run mode, can be client|server, default to beclient")
-	var config = flag.String("c", "g-arrow.yaml", "Config path, default to be ./g-arrow.yaml")
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "-help" {
+		runLegacy(args)
+		return
+	}
 
-	flag.Parse()
+	switch args[0] {
+	case "server", "client":
+		runMode(args[0], args[1:])
+	case "keygen":
+		runKeygen(args[1:])
+	case "ca":
+		runCA(args[1:])
+	case "config":
+		if len(args) < 2 || args[1] != "check" {
+			exitUsage("Usage: garrow config check [flags]")
+		}
+		runConfigCheck(args[2:])
+	case "url":
+		if len(args) < 2 {
+			exitUsage("Usage: garrow url export|import")
+		}
+		switch args[1] {
+		case "export":
+			runURLExport(args[2:])
+		case "import":
+			runURLImport(args[2:])
+		default:
+			exitUsage("Usage: garrow url export|import")
+		}
+	case "version":
+		runVersion()
+	case "help", "-h", "-help":
+		fmt.Print(usage)
+	default:
+		exitUsage(fmt.Sprintf("Unknown command: %s\n\n%s", args[0], usage))
+	}
+}
 
-	c := arrow.NewConfig(*config)
+// runLegacy keeps `garrow -m client|server` working
+func runLegacy(args []string) {
+	fs := flag.NewFlagSet("garrow", flag.ExitOnError)
+	var mode = fs.String("m", "client", "Deprecated, use 'garrow client|server'. Run mode, can be client|server, default to beclient")
+	cf := newConfigFlags(fs)
+	fs.Parse(args)
+
+	if *mode != "client" && *mode != "server" {
+		exitUsage("Unknow run mode")
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "m" {
+			fmt.Fprintf(os.Stderr, "-m is deprecated, use 'garrow %s' instead\n", *mode)
+		}
+	})
+	run(*mode, cf)
+}
+
+func runMode(mode string, args []string) {
+	fs := flag.NewFlagSet(mode, flag.ExitOnError)
+	cf := newConfigFlags(fs)
+	fs.Parse(args)
+	run(mode, cf)
+}
+
+func run(mode string, cf *configFlags) {
+	c := cf.load()
+	if *cf.print {
+		fmt.Print(c)
+		return
+	}
 
 	var s arrow.Runnable
-	if *mode == "client" {
+	if mode == "client" {
 		s = arrow.NewClient(c)
-	} else if *mode == "server" {
-		s = arrow.NewServer(c)
 	} else {
-		fmt.Fprintln(os.Stderr, "Unknow run mode")
-		os.Exit(1)
+		s = arrow.NewServer(c)
 	}
 	log.Fatal(s.Run())
 }
+
+func runConfigCheck(args []string) {
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	var mode = fs.String("m", "client", "Check as client|server")
+	cf := newConfigFlags(fs)
+	fs.Parse(args)
+
+	c := cf.load()
+	if *mode == "server" && c.ServerAddress == "" {
+		exitOnError(fmt.Errorf("config.server can not be empty"))
+	}
+	if *mode == "client" && (c.ServerAddress == "" || c.LocalAddress == "") {
+		exitOnError(fmt.Errorf("config.server and config.local can not be empty"))
+	}
+	if c.Password == "" {
+		exitOnError(fmt.Errorf("config.password can not be empty"))
+	}
+	fmt.Print(c)
+	fmt.Fprintln(os.Stderr, "config ok")
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func exitUsage(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	os.Exit(2)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ibigbug/GArrow/arrow"
+)
+
+// configFlags binds -c, -print-config and one flag per config key to a FlagSet
+type configFlags struct {
+	fs    *flag.FlagSet
+	path  *string
+	print *bool
+}
+
+func newConfigFlags(fs *flag.FlagSet) *configFlags {
+	cf := &configFlags{
+		fs:    fs,
+		path:  fs.String("c", defaultConfig, "Config path, default to be ./g-arrow.yaml, also "+arrow.EnvName("config")),
+		print: fs.Bool("print-config", false, "Print the effective config with secrets redacted and exit"),
+	}
+	for _, key := range arrow.ConfigKeys {
+		fs.String(key, "", fmt.Sprintf("Override config %s, also %s", key, arrow.EnvName(key)))
+	}
+	fs.String("u", "", "Shorthand for -uri, a garrow:// connection uri")
+	return cf
+}
+
+// load applies the YAML file, then GARROW_* env, then flags. Flags are set
+// in ConfigKeys order like env, so -u/-uri comes before the fields it fills.
+func (cf *configFlags) load() *arrow.Config {
+	c := arrow.NewConfig(cf.configPath())
+	exitOnError(c.LoadEnv())
+	set := map[string]string{}
+	cf.fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+	if u, ok := set["u"]; ok {
+		set["uri"] = u
+	}
+	_, password := set["password"]
+	if _, ok := set["password-file"]; ok && password {
+		exitOnError(fmt.Errorf("-password and -password-file are exclusive"))
+	}
+	for _, key := range arrow.ConfigKeys {
+		if v, ok := set[key]; ok {
+			exitOnError(c.Set(key, v))
+		}
+	}
+	exitOnError(c.Check())
+	return c
+}
+
+// configPath picks -c over GARROW_CONFIG. A missing default config file is
+// not an error, so env and flags alone are enough to run in containers.
+func (cf *configFlags) configPath() string {
+	explicit := false
+	cf.fs.Visit(func(f *flag.Flag) {
+		if f.Name == "c" {
+			explicit = true
+		}
+	})
+	if explicit {
+		return *cf.path
+	}
+	if p, ok := os.LookupEnv(arrow.EnvName("config")); ok {
+		return p
+	}
+	if _, err := os.Stat(*cf.path); os.IsNotExist(err) {
+		return ""
+	}
+	return *cf.path
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ibigbug/GArrow/arrow"
+)
+
+func runKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	var server = fs.String("server", "0.0.0.0:9999", "Address the server listens on")
+	var public = fs.String("public", "", "Address clients dial, default to be -server")
+	var local = fs.String("local", "127.0.0.1:9998", "Address the client listens on")
+	var method = fs.String("method", arrow.DefaultMethod, "Cipher method")
+	var out = fs.String("o", "", "Write server.yaml and client.yaml into this directory instead of stdout")
+	fs.Parse(args)
+
+	key, err := arrow.GenerateKey()
+	exitOnError(err)
+	_, err = arrow.NewCipher(*method, key)
+	exitOnError(err)
+
+	sc := &arrow.Config{
+		ServerAddress: *server,
+		Password:      key,
+		Method:        *method,
+	}
+	cc := &arrow.Config{
+		ServerAddress: *public,
+		LocalAddress:  *local,
+		Password:      key,
+		Method:        *method,
+	}
+	if cc.ServerAddress == "" {
+		cc.ServerAddress = *server
+	}
+
+	sb, err := sc.Marshal()
+	exitOnError(err)
+	cb, err := cc.Marshal()
+	exitOnError(err)
+
+	if *out == "" {
+		fmt.Printf("# server\n%s---\n# client, %s\n%s", sb, cc.URI(), cb)
+		return
+	}
+	exitOnError(ioutil.WriteFile(filepath.Join(*out, "server.yaml"), sb, 0600))
+	exitOnError(ioutil.WriteFile(filepath.Join(*out, "client.yaml"), cb, 0600))
+	fmt.Fprintln(os.Stderr, "Written", filepath.Join(*out, "server.yaml"), filepath.Join(*out, "client.yaml"))
+}
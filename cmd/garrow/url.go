@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ibigbug/GArrow/arrow"
+)
+
+func runURLExport(args []string) {
+	fs := flag.NewFlagSet("url export", flag.ExitOnError)
+	cf := newConfigFlags(fs)
+	fs.Parse(args)
+
+	c := cf.load()
+	if c.ServerAddress == "" {
+		exitOnError(fmt.Errorf("config.server can not be empty"))
+	}
+	fmt.Println(c.URI())
+}
+
+func runURLImport(args []string) {
+	fs := flag.NewFlagSet("url import", flag.ExitOnError)
+	var local = fs.String("local", "127.0.0.1:9998", "Address the client listens on")
+	var out = fs.String("o", "", "Write the client config to this file instead of stdout")
+	fs.Parse(args)
+	// flag stops at the uri, the flags after it are parsed too
+	var uris []string
+	for fs.NArg() > 0 {
+		uris = append(uris, fs.Arg(0))
+		fs.Parse(fs.Args()[1:])
+	}
+
+	if len(uris) != 1 {
+		exitUsage("Usage: garrow url import garrow://... [-local addr] [-o file]")
+	}
+	c, err := arrow.ParseURI(uris[0])
+	exitOnError(err)
+	c.LocalAddress = *local
+	_, err = arrow.NewCipher(c.Method, c.Password)
+	exitOnError(err)
+
+	b, err := c.Marshal()
+	exitOnError(err)
+	if *out == "" {
+		fmt.Print(string(b))
+		return
+	}
+	exitOnError(ioutil.WriteFile(*out, b, 0600))
+}
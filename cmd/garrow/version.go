@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Set at build time with -ldflags "-X main.gitCommit=... -X main.buildDate=..."
+var (
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
+func runVersion() {
+	fmt.Printf("garrow %s\n", VERSION)
+	fmt.Printf("commit:  %s\n", gitCommit)
+	fmt.Printf("built:   %s\n", buildDate)
+	fmt.Printf("go:      %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}